@@ -1,25 +1,38 @@
 package macosnotarylib
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -29,8 +42,129 @@ const (
 	apiSubmssions = "https://appstoreconnect.apple.com/notary/v2/submissions"
 )
 
+// AudienceAppStoreConnectV1 is the JWT audience of the App Store Connect API, which includes the Notary API.
+const AudienceAppStoreConnectV1 = "appstoreconnect-v1"
+
+// knownAudiences are the JWT audiences known to work with the Notary API.
+var knownAudiences = map[string]bool{
+	AudienceAppStoreConnectV1: true,
+}
+
+// ErrUnauthorized is matched by errors.Is when the Notary API rejects the JWT token,
+// e.g. because of a wrong issuer ID, key ID or private key.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// ErrDuplicateSubmission is returned from Submit when RejectDuplicates is set
+// and a file with the same checksum has already been submitted by this Notarizer.
+var ErrDuplicateSubmission = errors.New("duplicate submission")
+
+// ErrArtifactTooLarge is returned when the artifact is larger than MaxArtifactSize.
+var ErrArtifactTooLarge = errors.New("artifact too large")
+
+// ErrNetwork is matched by errors.Is when the Notary API could not be reached,
+// e.g. because of a DNS failure or no network.
+var ErrNetwork = errors.New("network error")
+
+// ErrInvalidIssuerID is returned from New when IssuerID is not a UUID,
+// e.g. because it was truncated or swapped with the key ID.
+var ErrInvalidIssuerID = errors.New("invalid issuer ID")
+
+// ErrSubmissionNotFound is matched by errors.Is when the Notary API doesn't know
+// the submission ID, e.g. a stale ID resumed from a SubmissionStore.
+// See SubmissionNotFoundError.
+var ErrSubmissionNotFound = errors.New("submission not found")
+
+// ErrClockDrift is returned when StrictClockDrift is set and the local clock
+// differs too much from the Notary API's clock.
+var ErrClockDrift = errors.New("clock drift")
+
+// The artifact formats accepted by the Notary API, identified by file extension.
+const (
+	FormatZip = "zip"
+	FormatDMG = "dmg"
+	FormatPkg = "pkg"
+)
+
+// contentTypes maps a format to the content type used for the S3 upload.
+// Apple does not document what it expects here. For zip we use the IANA registered type,
+// for dmg the type macOS reports for disk images. A flat installer package is a xar
+// archive, which has no registered type (Apple's application/vnd.apple.installer+xml
+// is for the XML distribution files), so pkg gets the generic application/octet-stream.
+var contentTypes = map[string]string{
+	FormatZip: "application/zip",
+	FormatDMG: "application/x-apple-diskimage",
+	FormatPkg: "application/octet-stream",
+}
+
+// ContentTypeFor returns the content type used when uploading an artifact of the given format (e.g. "dmg").
+// Unknown formats get application/octet-stream.
+func ContentTypeFor(format string) string {
+	if contentType, found := contentTypes[strings.ToLower(format)]; found {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// SupportedFormats returns the artifact formats accepted by the Notary API,
+// i.e. the file extensions without the dot, sorted, e.g. to filter a file picker.
+func SupportedFormats() []string {
+	formats := make([]string, 0, len(contentTypes))
+	for format := range contentTypes {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// formatFromFilename returns the format of filename based on its extension, e.g. "zip".
+func formatFromFilename(filename string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+}
+
+// versionSuffixRe matches a version suffix such as "-1.2.3", "_v1.2" or " 1.2.3-beta.1".
+var versionSuffixRe = regexp.MustCompile(`[-_ ]v?\d+(\.\d+)+([-+][0-9A-Za-z.]+)?$`)
+
+// StripVersionSuffix returns the base name of filename without its version suffix,
+// e.g. "App.zip" for "dist/App-1.2.3.zip", to group the submissions in Apple's
+// history by product. It can be used as SubmissionNameFunc.
+//
+// A version suffix is a "-", "_" or " " followed by an optional "v", at least two
+// dot separated numbers and an optional pre-release or build suffix starting with
+// "-" or "+", right before the file extension.
+// Names without such a suffix are returned unchanged.
+func StripVersionSuffix(filename string) string {
+	name := filepath.Base(filename)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	stripped := versionSuffixRe.ReplaceAllString(base, "")
+	if stripped == "" {
+		return name
+	}
+	return stripped + ext
+}
+
+// isUUID reports whether s is a UUID in its canonical form, e.g. 57246542-96fe-1a63-e053-0824d011072a.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, r := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return false
+			}
+		default:
+			if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // New creates a new Notarizer. You can call Submit multiple time to submit multiple files,
-// but the JWT token will eventually expire, default after 20 minutes.
+// the JWT token is refreshed when it's about to expire (see TokenTimeout).
 func New(opts Options) (*Notarizer, error) {
 	if opts.InfoLoggerf == nil {
 		opts.InfoLoggerf = func(format string, a ...any) {}
@@ -40,6 +174,10 @@ func New(opts Options) (*Notarizer, error) {
 		return nil, errors.New("SignFunc is required")
 	}
 
+	if !isUUID(opts.IssuerID) {
+		return nil, fmt.Errorf("%w %q, expected a UUID, e.g. 57246542-96fe-1a63-e053-0824d011072a", ErrInvalidIssuerID, opts.IssuerID)
+	}
+
 	if opts.SubmissionTimeout == 0 {
 		opts.SubmissionTimeout = 5 * time.Minute
 	}
@@ -48,17 +186,58 @@ func New(opts Options) (*Notarizer, error) {
 		opts.TokenTimeout = 20 * time.Minute
 	}
 
+	for k := range opts.ExtraClaims {
+		if reservedClaims[k] {
+			return nil, fmt.Errorf("ExtraClaims: the %q claim can not be overridden", k)
+		}
+	}
+
+	if opts.PollStrategy == nil {
+		opts.PollStrategy = defaultPollStrategy
+	}
+
+	if opts.MaxCredentialRefreshes <= 0 {
+		opts.MaxCredentialRefreshes = 1
+	}
+
+	if opts.MaxClockDrift <= 0 {
+		opts.MaxClockDrift = time.Minute
+	}
+
+	if opts.Audience == "" {
+		opts.Audience = AudienceAppStoreConnectV1
+	}
+	if !knownAudiences[opts.Audience] {
+		opts.InfoLoggerf("Warning: unknown JWT audience %q, the Notary API expects %q", opts.Audience, AudienceAppStoreConnectV1)
+	}
+
+	switch {
+	case opts.HTTPClient == nil && opts.S3HTTPClient == nil:
+		opts.HTTPClient = http.DefaultClient
+	case opts.HTTPClient == nil:
+		opts.HTTPClient = opts.S3HTTPClient
+	case opts.S3HTTPClient == nil:
+		opts.S3HTTPClient = opts.HTTPClient
+	}
+
 	n := &Notarizer{
-		infof: opts.InfoLoggerf,
-		opts:  opts,
+		infof:      opts.InfoLoggerf,
+		opts:       opts,
+		submitted:  make(map[string]bool),
+		baseURL:    apiSubmssions,
+		newSession: session.NewSession,
 	}
 
-	signature, err := n.createAndSignToken()
-	if err != nil {
-		return nil, err
+	if opts.MaxConcurrentUploads > 0 {
+		n.uploadSem = make(chan struct{}, opts.MaxConcurrentUploads)
+	}
+	if opts.MaxConcurrency > 0 {
+		n.submitSem = make(chan struct{}, opts.MaxConcurrency)
 	}
 
-	n.signature = signature
+	if _, err := n.currentSignature(); err != nil {
+		return nil, err
+	}
 
 	return n, nil
 }
@@ -67,6 +246,9 @@ type Options struct {
 	// InfoLogger will log information about the notarization process. No secrets.
 	InfoLoggerf func(format string, a ...any)
 
+	// If set, the log lines include more details, e.g. the artifact size.
+	Verbose bool
+
 	// Your issuer ID from the API Keys page in App Store Connect; for example, 57246542-96fe-1a63-e053-0824d011072a.
 	IssuerID string
 
@@ -74,19 +256,247 @@ type Options struct {
 	Kid string
 
 	// Timeout waiting for the notarization to complete.
-	// Defaults to 5 minutes.
+	// Defaults to 5 minutes. Set it to a negative value to wait indefinitely.
+	// A sooner deadline on the context passed to SubmitContext takes precedence.
 	SubmissionTimeout time.Duration
 
+	// The audience (aud) of the JWT token.
+	// Defaults to AudienceAppStoreConnectV1, the only audience known to work with the Notary API.
+	Audience string
+
+	// PollStrategy decides how long to wait before each status check.
+	// The default waits 10 seconds plus 1 second per check.
+	// See NewFullJitter for an alternative when running many submissions.
+	PollStrategy PollStrategy
+
+	// MinPollInterval and MaxPollInterval, if set, clamp the delays
+	// returned by PollStrategy.
+	MinPollInterval time.Duration
+	MaxPollInterval time.Duration
+
+	// ExtraClaims are added to the claims of the JWT token.
+	// The iss, iat, exp, aud and scope claims are set by the library and can not be overridden.
+	ExtraClaims map[string]any
+
 	// The JWT signing token expires after this duration,
 	// default is 20 minutes.
 	TokenTimeout time.Duration
 
+	// TokenCache, if set, is used to share signed JWT tokens between Notarizers,
+	// so a new token is only signed when there's no valid token in the cache.
+	// See NewMemoryTokenCache.
+	TokenCache TokenCache
+
+	// The maximum number of S3 uploads running at the same time when
+	// Submit is called concurrently. The rest will wait for a free slot.
+	// Default is no limit.
+	MaxConcurrentUploads int
+
+	// The maximum number of submissions running at the same time, from start to finish,
+	// across SubmitContext, SubmitPrepared, SubmitURL and the methods calling them.
+	// The rest will wait for a free slot. Default is no limit.
+	MaxConcurrency int
+
+	// If set, zip archives are read through before upload to verify that the
+	// central directory is readable and that the checksums of all entries match.
+	// Note that this reads the entire archive.
+	ValidateArchive bool
+
+	// If set, the already uploaded parts of a failed multipart upload are not removed,
+	// which can be useful when debugging upload problems with Apple.
+	// Note that the parts are left in Apple's bucket and count towards its storage.
+	LeavePartsOnError bool
+
+	// UploadOptions are applied to the s3manager.Uploader used to upload the artifact,
+	// e.g. to tune PartSize or Concurrency.
+	// Artifacts smaller than PartSize (5 MiB by default) are uploaded in a single PutObject.
+	// Use with care, misconfiguring the uploader may break the upload.
+	UploadOptions []func(*s3manager.Uploader)
+
+	// ServerSideEncryption and SSEKMSKeyID, if set, are passed on to the S3 upload request
+	// (e.g. "aws:kms" and a key ID), for tooling that inspects the upload requests.
+	// The bucket is Apple's, and its policy decides how the artifact is stored.
+	ServerSideEncryption string
+	SSEKMSKeyID          string
+
+	// MaxArtifactSize, if set, is the maximum size in bytes of the artifacts submitted.
+	// Larger artifacts fail with ErrArtifactTooLarge before anything is uploaded,
+	// and SubmitURL stops downloading once the limit is exceeded.
+	// Apple doesn't document a limit for the Notary API, so there is no default limit.
+	MaxArtifactSize int64
+
+	// MaxUploadBytesPerSec, if set, limits the rate the artifact is read for the upload,
+	// e.g. to not starve other jobs on a shared CI runner.
+	// The AWS SDK may read the artifact more than once (e.g. to compute checksums),
+	// which also counts against the limit. The default is no limit.
+	MaxUploadBytesPerSec int64
+
+	// RefreshCredsOnUploadAuthError, if set, creates a new submission to get new
+	// S3 credentials and retries the upload when it fails because of invalid
+	// credentials or bucket (e.g. AccessDenied or NoSuchBucket).
+	// The failed submission is left as is.
+	RefreshCredsOnUploadAuthError bool
+
+	// MaxCredentialRefreshes is the maximum number of new submissions created by
+	// RefreshCredsOnUploadAuthError for one file. Defaults to 1.
+	MaxCredentialRefreshes int
+
+	// UploadBodyWrapper, if set, wraps the body uploaded to S3,
+	// e.g. to compute an additional hash or to tee the upload to another sink.
+	// The returned reader must support seeking, the uploader will seek
+	// when computing checksums and retrying.
+	UploadBodyWrapper func(io.ReadSeeker) io.ReadSeeker
+
+	// If set, Submit will fail with ErrDuplicateSubmission if a file with the same
+	// checksum has already been submitted by this Notarizer.
+	// Submissions that failed before the upload completed don't count.
+	// The default is to log a warning and submit it again.
+	RejectDuplicates bool
+
+	// SubmissionNameFunc, if set, returns the submission name shown in Apple's
+	// submission history for the given file, e.g. to add a build number.
+	// Defaults to the base name of the file. Not used by SubmitURL.
+	SubmissionNameFunc func(filename string) string
+
+	// ManifestDir, if set, is where a JSON Manifest is written for each completed
+	// submission, named <submission ID>.json, e.g. for supply chain records.
+	// The manifest contains no secrets.
+	// Failing to write it is logged as a warning and does not fail the submission.
+	ManifestDir string
+
+	// CheckClockDrift, if set, compares the local clock against the Date header
+	// of a Notary API response and warns if they differ by more than MaxClockDrift.
+	// The check is done by CheckCredentials (and Warm) or, if they haven't been called,
+	// by listing submissions before the first submission is created.
+	// A drifting clock makes Apple reject the JWT token with a confusing error.
+	CheckClockDrift bool
+
+	// MaxClockDrift is the clock drift tolerated by CheckClockDrift.
+	// Defaults to 1 minute.
+	MaxClockDrift time.Duration
+
+	// If set, a clock drift detected by CheckClockDrift fails CheckCredentials
+	// or the submission with ErrClockDrift instead of logging a warning.
+	// Nothing is submitted then, and the next call checks again.
+	StrictClockDrift bool
+
+	// HTTPClient is used for the Notary API and the downloads in SubmitURL.
+	// Defaults to S3HTTPClient if that is set, else http.DefaultClient.
+	HTTPClient *http.Client
+
+	// S3HTTPClient is used for the uploads to S3, e.g. to use a different proxy
+	// than for the Notary API. Defaults to HTTPClient if that is set.
+	// The AWS SDK may modify its transport, e.g. to add the CA bundle in AWS_CA_BUNDLE,
+	// and requires it to be an *http.Transport if so.
+	S3HTTPClient *http.Client
+
+	// DownloadHeader is added to the download request in SubmitURL,
+	// e.g. an Authorization header.
+	DownloadHeader http.Header
+
+	// OnSubmissionCreated, if set, is called with the submission ID as soon as
+	// the submission is created, before the file is uploaded.
+	OnSubmissionCreated func(id string)
+
+	// OnProcessingStart, if set, is called with the submission ID once the file
+	// is uploaded, before Apple's processing is polled for the first time.
+	OnProcessingStart func(id string)
+
+	// OnLogAvailable, if set, is called once per submission with the URL of
+	// the developer log, e.g. to create a CI annotation linking to it.
+	// On failure, the log URL is always fetched (unless SkipLogFetchOnFailure is set);
+	// on success, it is only fetched if this is set.
+	OnLogAvailable func(submissionID, logURL string)
+
+	// SkipLogFetchOnFailure disables fetching the log URL when a submission is rejected,
+	// e.g. for networks where the request fails. StatusError.LogURL will then be empty;
+	// use LogURL to fetch it later.
+	SkipLogFetchOnFailure bool
+
+	// SubmissionStore, if set, stores the ID of each uploaded submission by key
+	// (see WithCallSubmissionKey), and a submission found in the store is resumed,
+	// i.e. its status is polled, instead of submitting the artifact again.
+	// With a persistent store, e.g. NewFileSubmissionStore, this makes re-runs
+	// of e.g. a CI job idempotent across process restarts.
+	// A submission that is rejected by Apple, or unknown to it, is deleted from the store,
+	// and an unknown one is submitted again.
+	SubmissionStore SubmissionStore
+
+	// PostAcceptHook, if set, is called with the Manifest of each accepted submission,
+	// e.g. to run "spctl --assess" on the artifact.
+	// A non-nil error fails the submission.
+	PostAcceptHook func(m Manifest) error
+
+	// EventChan, if set, receives the Events of all submissions, see SubmitWithProgress.
+	// Events are dropped if the channel isn't ready to receive them,
+	// so use a buffered channel and keep up with them to not miss any.
+	EventChan chan<- Event
+
+	// OnAPIExchange, if set, is called after every call to the Notary API,
+	// e.g. to keep an audit trail. The Authorization header of the request and the
+	// AWS credentials in the response body are replaced with "REDACTED".
+	// The response body is already read and closed, use body instead.
+	OnAPIExchange func(req *http.Request, resp *http.Response, body []byte)
+
 	// The signing function to use.
 	// Return the result of token.SignedString(appStoreConnectPrivateKey)
 	// where the private key is the one connected to the kid field.
 	SignFunc func(token *jwt.Token) (string, error)
 }
 
+// PollStrategy decides how long to wait before each status check.
+// Implementations must be safe for concurrent use.
+type PollStrategy interface {
+	// Delay returns how long to wait before status check number attempt, starting at 1.
+	Delay(attempt int) time.Duration
+}
+
+// PollStrategyFunc is an adapter to allow the use of a func as a PollStrategy.
+type PollStrategyFunc func(attempt int) time.Duration
+
+// Delay returns f(attempt).
+func (f PollStrategyFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+var defaultPollStrategy = PollStrategyFunc(func(attempt int) time.Duration {
+	return time.Duration(10+attempt) * time.Second
+})
+
+// NewFullJitter creates a PollStrategy with exponential backoff and full jitter:
+// the delay is random between base and base*2^attempt, capped at max.
+// This spreads the status checks of many concurrent submissions better than a fixed delay.
+// If src is nil, a source seeded with the current time is used.
+func NewFullJitter(base, max time.Duration, src rand.Source) PollStrategy {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	return &fullJitter{base: base, max: max, rnd: rand.New(src)}
+}
+
+type fullJitter struct {
+	base, max time.Duration
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (f *fullJitter) Delay(attempt int) time.Duration {
+	upper := f.base
+	for i := 0; i < attempt && upper < f.max; i++ {
+		upper *= 2
+	}
+	if upper > f.max {
+		upper = f.max
+	}
+	if upper <= f.base {
+		return f.base
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.base + time.Duration(f.rnd.Int63n(int64(upper-f.base)+1))
+}
+
 // LoadPrivateKeyFromEnvBase64 is a helper function to load a key from the environment in base64 format.
 func LoadPrivateKeyFromEnvBase64(envKey string) (*ecdsa.PrivateKey, error) {
 	keyBase64 := os.Getenv(envKey)
@@ -104,269 +514,2107 @@ func LoadPrivateKeyFromEnvBase64(envKey string) (*ecdsa.PrivateKey, error) {
 	return key, nil
 }
 
-// Notarizer is the main struct for notarizing files.
-type Notarizer struct {
-	signature string
-	infof     func(format string, a ...any)
-	opts      Options
+// LoadPrivateKeyFromEncryptedPEM decrypts the passphrase protected PEM block in pemBytes
+// and parses the private key in it.
+// Only the legacy RFC 1423 encryption is supported (the "Proc-Type: 4,ENCRYPTED" header),
+// with DES, 3DES or AES-128/192/256 in CBC mode, e.g. as written by
+// "openssl ec -aes256". Encrypted PKCS #8 ("ENCRYPTED PRIVATE KEY") is not supported.
+func LoadPrivateKeyFromEncryptedPEM(pemBytes []byte, passphrase string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	//lint:ignore SA1019 RFC 1423 is what's requested here, despite its weaknesses.
+	if !x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("PEM block %q is not encrypted", block.Type)
+	}
+	//lint:ignore SA1019 RFC 1423 is what's requested here, despite its weaknesses.
+	der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt PEM block: %w", err)
+	}
+	return jwt.ParseECPrivateKeyFromPEM(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}))
 }
 
-// Submit submits a new notarization request.
-func (n *Notarizer) Submit(filename string) error {
-	f, err := os.Open(filename)
+// EncodeKeyForEnv reads the .p8 private key file downloaded from App Store Connect and
+// returns it base64 encoded, the format expected by LoadPrivateKeyFromEnvBase64.
+func EncodeKeyForEnv(p8Path string) (string, error) {
+	keyBytes, err := os.ReadFile(p8Path)
 	if err != nil {
-		return err
+		return "", err
 	}
-	var fileBuf bytes.Buffer
-
-	defer f.Close()
-	h := sha256.New()
-	w := io.MultiWriter(h, &fileBuf)
-	if _, err := io.Copy(w, f); err != nil {
-		return err
+	if _, err := jwt.ParseECPrivateKeyFromPEM(keyBytes); err != nil {
+		return "", fmt.Errorf("%s: %w", p8Path, err)
 	}
+	return base64.StdEncoding.EncodeToString(keyBytes), nil
+}
 
-	checksum := hex.EncodeToString(h.Sum(nil))
-	submissionName := filepath.Base(filename)
-
-	n.infof("Submitting %s with checksum %s", submissionName, checksum)
-
-	req := &submissionRequest{
-		Sha256:         checksum,
-		SubmissionName: submissionName,
+// OptionsFromJSON creates Options from a JSON config on the form
+//
+//	{"issuerId": "...", "keyId": "...", "keyPath": "/path/to/AuthKey.p8"}
+//
+// The private key is loaded from keyPath and used in the returned SignFunc.
+func OptionsFromJSON(r io.Reader) (Options, error) {
+	var cfg struct {
+		IssuerID string `json:"issuerId"`
+		KeyID    string `json:"keyId"`
+		KeyPath  string `json:"keyPath"`
 	}
-
-	var buf bytes.Buffer
-
-	if err := json.NewEncoder(&buf).Encode(req); err != nil {
-		return err
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		return Options{}, fmt.Errorf("failed to decode config: %w", err)
 	}
-
-	request, err := n.newAPIRequest("POST", apiSubmssions, &buf)
-	if err != nil {
-		return err
+	switch {
+	case cfg.IssuerID == "":
+		return Options{}, errors.New("issuerId is required")
+	case cfg.KeyID == "":
+		return Options{}, errors.New("keyId is required")
+	case cfg.KeyPath == "":
+		return Options{}, errors.New("keyPath is required")
 	}
 
-	response, err := http.DefaultClient.Do(request)
+	keyBytes, err := os.ReadFile(cfg.KeyPath)
 	if err != nil {
-		return err
-	}
-	if response.StatusCode != http.StatusOK {
-		return errors.New(response.Status)
+		return Options{}, err
 	}
-
-	defer response.Body.Close()
-	body, err := io.ReadAll(response.Body)
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyBytes)
 	if err != nil {
-		return err
+		return Options{}, err
 	}
 
-	var resp submissionResponse
-	if err := json.Unmarshal(body, &resp); err != nil {
-		return err
-	}
+	return Options{
+		IssuerID: cfg.IssuerID,
+		Kid:      cfg.KeyID,
+		SignFunc: func(token *jwt.Token) (string, error) {
+			return token.SignedString(key)
+		},
+	}, nil
+}
 
-	attrs := resp.Data.Attributes
-	s3Config := &aws.Config{
-		Region:      aws.String("us-west-2"),
-		Credentials: credentials.NewStaticCredentials(attrs.AwsAccessKeyID, attrs.AwsSecretAccessKey, attrs.AwsSessionToken),
+// VerifySignature verifies the code signature of filename (e.g. a binary, an .app or a .dmg)
+// using codesign --verify --deep --strict, a quick check to run before archiving and submitting it.
+// This requires macOS and the codesign tool.
+func VerifySignature(filename string) error {
+	if runtime.GOOS != "darwin" {
+		return errors.New("VerifySignature requires macOS")
 	}
-	session, err := session.NewSession(s3Config)
+	out, err := exec.Command("codesign", "--verify", "--deep", "--strict", filename).CombinedOutput()
 	if err != nil {
-		return err
-	}
-	uploader := s3manager.NewUploader(session)
-	input := &s3manager.UploadInput{
-		Bucket:      aws.String(attrs.Bucket),
-		Key:         aws.String(attrs.Object),
-		Body:        &fileBuf,
-		ContentType: aws.String("application/zip"),
+		return fmt.Errorf("codesign verification of %s failed: %w: %s", filename, err, bytes.TrimSpace(out))
 	}
+	return nil
+}
 
-	output, err := uploader.UploadWithContext(context.Background(), input)
+// VerifyStaple verifies that a notarization ticket is stapled to filename (e.g. an .app, .dmg or .pkg)
+// and that it's valid, using xcrun stapler validate.
+// This requires macOS and the Xcode command line tools.
+func VerifyStaple(filename string) error {
+	if runtime.GOOS != "darwin" {
+		return errors.New("VerifyStaple requires macOS")
+	}
+	out, err := exec.Command("xcrun", "stapler", "validate", filename).CombinedOutput()
 	if err != nil {
-		return err
+		return fmt.Errorf("stapler validation of %s failed: %w: %s", filename, err, bytes.TrimSpace(out))
 	}
+	return nil
+}
 
-	n.infof("Successfully uploaded file to S3 location %s", output.Location)
+// Notarizing is the interface implemented by Notarizer,
+// useful to substitute a fake in tests of code using this library.
+type Notarizing interface {
+	// Submit submits a new notarization request and waits for it to complete.
+	Submit(filename string, opts ...SubmitOption) error
 
-	ctx, cancel := context.WithTimeout(context.Background(), n.opts.SubmissionTimeout)
-	defer cancel()
+	// SubmitContext is like Submit but with a context.
+	SubmitContext(ctx context.Context, filename string, opts ...SubmitOption) error
 
-	var (
-		done  bool
-		count int
-	)
+	// SubmitURL downloads the artifact at url and submits it as name.
+	SubmitURL(ctx context.Context, url, name string, opts ...SubmitOption) error
 
-	for !done {
-		select {
-		case <-ctx.Done():
-			return errors.New("timeout waiting for notarize submission response")
-		default:
-			count++
-			time.Sleep(time.Duration(10+count) * time.Second)
-			var err error
-			done, err = n.checkStatus(count, resp.Data.ID)
-			if err != nil {
-				return err
-			}
-			if done {
-				n.infof("Notarization completed!")
-			}
-		}
-	}
+	// SubmitPrepared submits an artifact prepared with Prepare.
+	SubmitPrepared(ctx context.Context, p *PreparedSubmission, opts ...SubmitOption) error
 
-	return nil
+	// SubmitWithProgress is like SubmitContext, but reports the progress on a channel.
+	SubmitWithProgress(ctx context.Context, filename string, opts ...SubmitOption) (<-chan Event, <-chan error)
 
+	// ListSubmissions lists the previous submissions for the team.
+	ListSubmissions(ctx context.Context, opts ListOptions) ([]Submission, error)
+
+	// CheckCredentials verifies the credentials without submitting anything.
+	CheckCredentials(ctx context.Context) error
+
+	// LogURL fetches the URL of the developer log for a submission.
+	LogURL(ctx context.Context, id string) (string, error)
+
+	// TokenClaims returns a copy of the claims in the current JWT token.
+	TokenClaims() (jwt.MapClaims, error)
+
+	// TokenExpiry returns when the current JWT token expires.
+	TokenExpiry() time.Time
+
+	// TokenValidFor returns how long the current JWT token is valid for.
+	TokenValidFor() time.Duration
 }
 
-// newAPIRequest creates a new API request with the JWT signature applied.
-func (n *Notarizer) newAPIRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
-	request, err := http.NewRequest(method, endpoint, body)
-	if err != nil {
-		return nil, err
-	}
-	request.Header.Set("Authorization", "Bearer "+n.signature)
-	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
-	return request, nil
+var _ Notarizing = (*Notarizer)(nil)
+
+// Notarizer is the main struct for notarizing files.
+type Notarizer struct {
+	// The current JWT token, refreshed before it expires.
+	tokenMu      sync.Mutex
+	signature    string
+	claims       jwt.MapClaims
+	tokenExpires time.Time
+
+	infof func(format string, a ...any)
+	opts  Options
+
+	// Limits the number of concurrent uploads, nil if no limit.
+	uploadSem chan struct{}
 
+	// Limits the number of concurrent submissions, nil if no limit.
+	submitSem chan struct{}
+
+	// The checksums of the files submitted.
+	submittedMu sync.Mutex
+	submitted   map[string]bool
+
+	// The metadata of the last API response.
+	lastResponseMu sync.Mutex
+	lastResponse   ResponseInfo
+
+	// The AWS session shared by all uploads, created on first use.
+	// Only the credentials differ between submissions.
+	s3SessionMu sync.Mutex
+	s3Session   *session.Session
+
+	// Whether the clock drift check has passed (or warned).
+	clockDriftMu      sync.Mutex
+	clockDriftChecked bool
+
+	// The endpoints, replaced in tests.
+	baseURL    string
+	s3Endpoint string
+
+	// Creates the AWS session, replaced in tests.
+	newSession func(cfgs ...*aws.Config) (*session.Session, error)
 }
 
-func (n *Notarizer) checkStatus(count int, id string) (bool, error) {
-	n.infof("[%d] Checking status of %s", count, id)
-	request, err := n.newAPIRequest("GET", apiSubmssions+"/"+id, nil)
-	if err != nil {
-		return false, err
+// MultiNotarizer notarizes on behalf of several Apple accounts,
+// each with its own credentials and Notarizer.
+type MultiNotarizer struct {
+	notarizers map[string]*Notarizer
+}
+
+// NewMultiNotarizer creates a new MultiNotarizer with the Options of each account, keyed by account name.
+func NewMultiNotarizer(accounts map[string]Options) (*MultiNotarizer, error) {
+	if len(accounts) == 0 {
+		return nil, errors.New("no accounts configured")
 	}
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return false, err
+	m := &MultiNotarizer{notarizers: make(map[string]*Notarizer, len(accounts))}
+	for account, opts := range accounts {
+		n, err := New(opts)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %w", account, err)
+		}
+		m.notarizers[account] = n
 	}
+	return m, nil
+}
 
-	if response.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("failed to check status for ID %s: %s", id, response.Status)
-	}
+// Notarizer returns the Notarizer of account, or nil if not found.
+func (m *MultiNotarizer) Notarizer(account string) *Notarizer {
+	return m.notarizers[account]
+}
 
-	defer response.Body.Close()
-	var resp submissionStatusResponse
-	if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
-		return false, err
+// Accounts returns the sorted account names.
+func (m *MultiNotarizer) Accounts() []string {
+	accounts := make([]string, 0, len(m.notarizers))
+	for account := range m.notarizers {
+		accounts = append(accounts, account)
 	}
+	sort.Strings(accounts)
+	return accounts
+}
 
-	switch resp.Data.Attributes.Status {
-	case "Accepted":
-		return true, nil
-	case "In Progress":
-		return false, nil
-	default:
-		if err := n.printLogInfo(id); err != nil {
-			log.Printf("error: failed to print logs: %s", err)
-		}
-		return false, fmt.Errorf("unexpected status: %s", resp.Data.Attributes.Status)
+// SubmitFor submits filename using the credentials of account and waits for it to complete.
+func (m *MultiNotarizer) SubmitFor(account, filename string, opts ...SubmitOption) error {
+	return m.SubmitForContext(context.Background(), account, filename, opts...)
+}
 
+// SubmitForContext is like SubmitFor but with a context.
+func (m *MultiNotarizer) SubmitForContext(ctx context.Context, account, filename string, opts ...SubmitOption) error {
+	n := m.notarizers[account]
+	if n == nil {
+		return fmt.Errorf("unknown account %q", account)
 	}
+	return n.SubmitContext(ctx, filename, opts...)
 }
 
-// printLogInfo prints some information about where to download the logs from.
-func (n *Notarizer) printLogInfo(id string) error {
-	n.infof("Checking status of %s", id)
-	request, err := n.newAPIRequest("GET", apiSubmssions+"/"+id+"/logs", nil)
-	if err != nil {
-		return err
-	}
-	response, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return err
+// SubmitOption overrides the Options of a single submission.
+type SubmitOption func(*submitOptions)
+
+// WithCallSubmissionTimeout overrides SubmissionTimeout for one submission.
+func WithCallSubmissionTimeout(d time.Duration) SubmitOption {
+	return func(o *submitOptions) {
+		o.timeout = d
 	}
+}
 
-	if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to fetch logs with ID %s: %s", id, response.Status)
+// WithCallSubmissionKey sets the key the submission is stored under in the SubmissionStore,
+// e.g. the checksum plus a build tag. Defaults to the checksum of the artifact.
+func WithCallSubmissionKey(key string) SubmitOption {
+	return func(o *submitOptions) {
+		o.storeKey = key
 	}
+}
 
-	defer response.Body.Close()
-	var resp logsResponse
-	if err := json.NewDecoder(response.Body).Decode(&resp); err != nil {
-		return err
+// WithCallName sets the submission name of one submission,
+// overriding SubmissionNameFunc and the name passed to SubmitURL.
+func WithCallName(name string) SubmitOption {
+	return func(o *submitOptions) {
+		o.name = name
 	}
+}
 
-	n.infof("Logs for %s can be found at %s", id, resp.Data.Attributes.DeveloperLogURL)
+// submitOptions holds the settings of a single submission.
+type submitOptions struct {
+	// The filename or URL the artifact was read from.
+	source string
 
-	return nil
+	// The submission name.
+	name string
 
-}
+	// The artifact format, e.g. "zip", from the artifact's file name,
+	// as the submission name may be changed to anything.
+	format string
 
-func (n *Notarizer) createAndSignToken() (string, error) {
-	exp := time.Now().Add(n.opts.TokenTimeout).UTC().Unix()
-	iat := time.Now().UTC().Unix()
+	// The submission timeout.
+	timeout time.Duration
 
-	method := jwt.SigningMethodES256
-	tok := &jwt.Token{
-		Header: map[string]interface{}{
-			"alg": method.Alg(),
-			"kid": n.opts.Kid,
-			"typ": "JWT",
-		},
-		Claims: jwt.MapClaims{
-			"iss": n.opts.IssuerID,
-			// The token’s creation time, in UNIX epoch time; for example, 1528407600.
-			"iat": iat,
-			// The token’s expiration time in Unix epoch time.
-			"exp": exp,
-			// Audience.
-			"aud": "appstoreconnect-v1",
-			// A list of operations you want App Store Connect to allow for this token.
-			"scope": []string{"/notary/v2"},
-		},
-		Method: method,
-	}
+	// Receives the events of the submission, if set.
+	onEvent func(Event)
 
-	return n.opts.SignFunc(tok)
+	// Options.EventChan.
+	eventChan chan<- Event
 
+	// The SubmissionStore key, defaults to the checksum.
+	storeKey string
 }
 
-type logsResponse struct {
-	Data struct {
-		ID         string `json:"id"`
-		Type       string `json:"type"`
-		Attributes struct {
-			DeveloperLogURL string `json:"developerLogUrl"`
-		} `json:"attributes"`
-	} `json:"data"`
-	Meta struct {
-	} `json:"meta"`
+func (o submitOptions) emit(e Event) {
+	if o.onEvent != nil {
+		o.onEvent(e)
+	}
+	if o.eventChan != nil {
+		select {
+		case o.eventChan <- e:
+		default:
+			// Never block the submission on a slow consumer.
+		}
+	}
 }
 
-type submissionRequest struct {
-	Sha256         string `json:"sha256"`
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// The submission is created, the upload is about to start.
+	EventSubmissionCreated EventType = iota + 1
+
+	// The upload to S3 has started.
+	EventUploadStarted
+
+	// The upload is done and Apple's processing has started.
+	EventProcessingStarted
+
+	// A status was received from Apple, e.g. "In Progress".
+	EventStatus
+
+	// The submission is accepted.
+	EventCompleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSubmissionCreated:
+		return "SubmissionCreated"
+	case EventUploadStarted:
+		return "UploadStarted"
+	case EventProcessingStarted:
+		return "ProcessingStarted"
+	case EventStatus:
+		return "Status"
+	case EventCompleted:
+		return "Completed"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is a step in the lifecycle of a submission, see SubmitWithProgress.
+type Event struct {
+	Type EventType
+
+	// The submission ID.
+	SubmissionID string
+
+	// The status reported by Apple, set for EventStatus and EventCompleted.
+	Status string
+}
+
+// SubmitWithProgress is like SubmitContext, but runs in the background and reports
+// the progress of the submission as events on the first channel, which is closed
+// when the submission is done. The result is then sent on the second channel.
+// The caller must receive from the event channel until it's closed or ctx is cancelled.
+func (n *Notarizer) SubmitWithProgress(ctx context.Context, filename string, opts ...SubmitOption) (<-chan Event, <-chan error) {
+	events := make(chan Event)
+	errc := make(chan error, 1)
+	onEvent := func(e Event) {
+		select {
+		case events <- e:
+		case <-ctx.Done():
+		}
+	}
+	opts = append(opts[:len(opts):len(opts)], func(o *submitOptions) {
+		o.onEvent = onEvent
+	})
+	go func() {
+		err := n.SubmitContext(ctx, filename, opts...)
+		close(events)
+		errc <- err
+		close(errc)
+	}()
+	return events, errc
+}
+
+// acquireSubmitSlot waits for a free submission slot if MaxConcurrency is set.
+// The returned func releases the slot.
+func (n *Notarizer) acquireSubmitSlot(ctx context.Context) (func(), error) {
+	if n.submitSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case n.submitSem <- struct{}{}:
+		return func() { <-n.submitSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (n *Notarizer) newSubmitOptions(source, name, format string, opts []SubmitOption) submitOptions {
+	so := submitOptions{
+		source:    source,
+		name:      name,
+		format:    format,
+		timeout:   n.opts.SubmissionTimeout,
+		eventChan: n.opts.EventChan,
+	}
+	for _, opt := range opts {
+		opt(&so)
+	}
+	return so
+}
+
+// Submit submits a new notarization request.
+func (n *Notarizer) Submit(filename string, opts ...SubmitOption) error {
+	return n.SubmitContext(context.Background(), filename, opts...)
+}
+
+// SubmitContext submits a new notarization request and waits for it to complete.
+// The wait is bounded by SubmissionTimeout or the deadline of ctx, whichever comes first.
+func (n *Notarizer) SubmitContext(ctx context.Context, filename string, opts ...SubmitOption) error {
+	release, err := n.acquireSubmitSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	submissionName := filepath.Base(filename)
+	if n.opts.SubmissionNameFunc != nil {
+		submissionName = n.opts.SubmissionNameFunc(filename)
+	}
+
+	if n.opts.MaxArtifactSize > 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := n.checkArtifactSize(submissionName, fi.Size()); err != nil {
+			return err
+		}
+	}
+
+	data, checksum, err := readArtifact(f)
+	if err != nil {
+		return err
+	}
+
+	return n.submitArtifact(ctx, n.newSubmitOptions(filename, submissionName, formatFromFilename(filename), opts), data, checksum)
+}
+
+// PreparedSubmission describes an artifact ready to be submitted,
+// e.g. on another machine with the credentials and network access, see Prepare.
+// It contains no secrets and can be serialized to JSON.
+type PreparedSubmission struct {
+	// The path to the artifact.
+	Path string `json:"path"`
+
+	// The submission name, e.g. "helloworld.zip".
 	SubmissionName string `json:"submissionName"`
+
+	// The SHA-256 checksum of the artifact.
+	Sha256 string `json:"sha256"`
+}
+
+// Prepare computes what's needed to submit filename later with SubmitPrepared.
+// It needs neither credentials nor network access.
+// The submission name is the base name of filename, as Prepare has no Options
+// and so doesn't apply a SubmissionNameFunc; set SubmissionName to change it.
+func Prepare(filename string) (*PreparedSubmission, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, checksum, err := readArtifact(f)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedSubmission{
+		Path:           filename,
+		SubmissionName: filepath.Base(filename),
+		Sha256:         checksum,
+	}, nil
+}
+
+// SubmitPrepared submits the artifact prepared with Prepare and waits for it to complete.
+// It fails if the artifact has changed since it was prepared.
+func (n *Notarizer) SubmitPrepared(ctx context.Context, p *PreparedSubmission, opts ...SubmitOption) error {
+	release, err := n.acquireSubmitSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	data, checksum, err := readArtifact(f)
+	if err != nil {
+		return err
+	}
+	if checksum != p.Sha256 {
+		return fmt.Errorf("%s has changed since it was prepared: checksum %s, expected %s", p.Path, checksum, p.Sha256)
+	}
+
+	if err := n.checkArtifactSize(p.SubmissionName, int64(len(data))); err != nil {
+		return err
+	}
+
+	return n.submitArtifact(ctx, n.newSubmitOptions(p.Path, p.SubmissionName, formatFromFilename(p.Path), opts), data, checksum)
+}
+
+// SubmitURL downloads the artifact at url and submits it as name, e.g. "helloworld.zip".
+// Use DownloadHeader to set e.g. the Authorization header of the download request.
+// Download failures are returned as a *DownloadError.
+func (n *Notarizer) SubmitURL(ctx context.Context, url, name string, opts ...SubmitOption) error {
+	release, err := n.acquireSubmitSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range n.opts.DownloadHeader {
+		request.Header[k] = v
+	}
+
+	response, err := n.opts.HTTPClient.Do(request)
+	if err != nil {
+		return &DownloadError{URL: url, Err: err}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return &DownloadError{URL: url, Err: errors.New(response.Status)}
+	}
+
+	var body io.Reader = response.Body
+	if n.opts.MaxArtifactSize > 0 {
+		if response.ContentLength > n.opts.MaxArtifactSize {
+			return n.checkArtifactSize(name, response.ContentLength)
+		}
+		// Stop reading just past the limit if the length is unknown or wrong.
+		body = io.LimitReader(body, n.opts.MaxArtifactSize+1)
+	}
+
+	data, checksum, err := readArtifact(body)
+	if err != nil {
+		return &DownloadError{URL: url, Err: err}
+	}
+
+	if err := n.checkArtifactSize(name, int64(len(data))); err != nil {
+		return err
+	}
+
+	return n.submitArtifact(ctx, n.newSubmitOptions(url, name, formatFromFilename(name), opts), data, checksum)
+}
+
+// DownloadError is returned from SubmitURL when the artifact could not be downloaded.
+type DownloadError struct {
+	URL string
+	Err error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("failed to download %s: %s", e.URL, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// checkArtifactSize returns ErrArtifactTooLarge if size exceeds MaxArtifactSize.
+func (n *Notarizer) checkArtifactSize(submissionName string, size int64) error {
+	if n.opts.MaxArtifactSize <= 0 || size <= n.opts.MaxArtifactSize {
+		return nil
+	}
+	n.infof("[%s] Size %s exceeds MaxArtifactSize %s", submissionName, formatSize(size), formatSize(n.opts.MaxArtifactSize))
+	return fmt.Errorf("%s is %d bytes, the limit is %d: %w", submissionName, size, n.opts.MaxArtifactSize, ErrArtifactTooLarge)
+}
+
+// readArtifact reads all of r and returns it with its SHA-256 checksum.
+func readArtifact(r io.Reader) ([]byte, string, error) {
+	var buf bytes.Buffer
+	h := sha256.New()
+	w := io.MultiWriter(h, &buf)
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// submitArtifact submits data with the given checksum and waits for it to complete.
+func (n *Notarizer) submitArtifact(ctx context.Context, so submitOptions, data []byte, checksum string) error {
+	submissionName := so.name
+
+	if n.opts.ValidateArchive && so.format == FormatZip {
+		if err := validateZip(data); err != nil {
+			return fmt.Errorf("%s: %w", submissionName, err)
+		}
+	}
+
+	// All log lines for this submission are prefixed with its name and, once known, its ID.
+	logPrefix := submissionName
+	infof := func(format string, a ...any) {
+		n.infof("[%s] "+format, append([]any{logPrefix}, a...)...)
+	}
+
+	var (
+		id, s3Location string
+		storeKey       string
+		resumed        bool
+		err            error
+	)
+	if n.opts.SubmissionStore != nil {
+		storeKey = so.storeKey
+		if storeKey == "" {
+			storeKey = checksum
+		}
+		id, resumed, err = n.opts.SubmissionStore.Get(storeKey)
+		if err != nil {
+			return err
+		}
+		if resumed {
+			logPrefix = submissionName + " " + id
+			infof("Resuming submission stored for key %q", storeKey)
+		}
+	}
+
+	if id == "" {
+		if err := n.checkClockDriftBeforeSubmit(ctx, infof); err != nil {
+			return err
+		}
+
+		alreadySubmitted := n.markSubmitted(checksum)
+		if alreadySubmitted {
+			if n.opts.RejectDuplicates {
+				return fmt.Errorf("%s with checksum %s: %w", submissionName, checksum, ErrDuplicateSubmission)
+			}
+			infof("Warning: file with checksum %s has already been submitted", checksum)
+		}
+
+		if n.opts.Verbose {
+			infof("Submitting %s (%s) with checksum %s", formatSize(int64(len(data))), checksum[:8], checksum)
+		} else {
+			infof("Submitting with checksum %s", checksum)
+		}
+
+		id, s3Location, err = n.createAndUpload(ctx, so, data, checksum, infof, func(id string) {
+			logPrefix = submissionName + " " + id
+		})
+		if err != nil {
+			if !alreadySubmitted {
+				// Allow a retry.
+				n.unmarkSubmitted(checksum)
+			}
+			return err
+		}
+
+		if n.opts.SubmissionStore != nil {
+			if err := n.opts.SubmissionStore.Put(storeKey, id); err != nil {
+				infof("Warning: failed to store submission: %s", err)
+			}
+		}
+	}
+
+	// The caller's deadline wins if it's sooner than SubmissionTimeout.
+	var (
+		waitCtx context.Context
+		cancel  context.CancelFunc
+	)
+	if so.timeout < 0 {
+		waitCtx, cancel = context.WithCancel(ctx)
+	} else {
+		waitCtx, cancel = context.WithTimeout(ctx, so.timeout)
+	}
+	defer cancel()
+
+	var (
+		done  bool
+		count int
+	)
+
+	manifest := Manifest{
+		Path:           so.source,
+		SubmissionName: submissionName,
+		Sha256:         checksum,
+		SubmissionID:   id,
+		S3Location:     s3Location,
+	}
+
+	// A single timer for all the polls, stopped when we return.
+	timer := time.NewTimer(0)
+	<-timer.C
+	defer timer.Stop()
+
+	for !done {
+		count++
+		timer.Reset(n.pollDelay(count))
+		select {
+		case <-waitCtx.Done():
+			return fmt.Errorf("failed waiting for notarize submission response: %w", waitCtx.Err())
+		case <-timer.C:
+		}
+		var status string
+		status, err = n.checkStatus(waitCtx, infof, count, id)
+		if status != "" {
+			so.emit(Event{Type: EventStatus, SubmissionID: id, Status: status})
+		}
+		done = status == "Accepted"
+		if err != nil {
+			if resumed && errors.Is(err, ErrSubmissionNotFound) {
+				infof("Stored submission not found, submitting again")
+				if err := n.opts.SubmissionStore.Delete(storeKey); err != nil {
+					return err
+				}
+				return n.submitArtifact(ctx, so, data, checksum)
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				if n.opts.SubmissionStore != nil {
+					// Let the next run submit again.
+					if err := n.opts.SubmissionStore.Delete(storeKey); err != nil {
+						infof("Warning: failed to delete stored submission: %s", err)
+					}
+				}
+				manifest.Status = statusErr.Status
+				manifest.PollCount = count
+				if err := n.writeManifest(manifest); err != nil {
+					infof("Warning: failed to write manifest: %s", err)
+				}
+			}
+			return err
+		}
+		if done {
+			infof("Notarization completed!")
+			manifest.Status = "Accepted"
+			manifest.PollCount = count
+			if err := n.writeManifest(manifest); err != nil {
+				infof("Warning: failed to write manifest: %s", err)
+			}
+			if n.opts.OnLogAvailable != nil {
+				// The log is only fetched on failure, so fetch it to pass it to the hook.
+				if logURL, err := n.printLogInfo(waitCtx, infof, id); err != nil {
+					infof("Warning: failed to fetch logs: %s", err)
+				} else {
+					n.opts.OnLogAvailable(id, logURL)
+				}
+			}
+		}
+	}
+
+	if n.opts.PostAcceptHook != nil {
+		if err := n.opts.PostAcceptHook(manifest); err != nil {
+			return fmt.Errorf("post accept hook for submission %s: %w", id, err)
+		}
+	}
+
+	so.emit(Event{Type: EventCompleted, SubmissionID: id, Status: "Accepted"})
+
+	return nil
+}
+
+// createAndUpload creates a new submission and uploads data to it,
+// returning the submission ID and the S3 location.
+// onCreated is called with the ID of each submission created.
+func (n *Notarizer) createAndUpload(ctx context.Context, so submitOptions, data []byte, checksum string, infof func(format string, a ...any), onCreated func(id string)) (string, string, error) {
+	var (
+		resp   submissionResponse
+		output *s3manager.UploadOutput
+		err    error
+	)
+	for refreshes := 0; ; refreshes++ {
+		resp, err = n.createSubmission(ctx, so.name, checksum)
+		if err != nil {
+			return "", "", err
+		}
+
+		onCreated(resp.Data.ID)
+
+		if n.opts.OnSubmissionCreated != nil {
+			n.opts.OnSubmissionCreated(resp.Data.ID)
+		}
+		so.emit(Event{Type: EventSubmissionCreated, SubmissionID: resp.Data.ID})
+		so.emit(Event{Type: EventUploadStarted, SubmissionID: resp.Data.ID})
+
+		output, err = n.upload(ctx, infof, resp.Data.Attributes, so.format, data)
+		if err == nil {
+			break
+		}
+		if !n.opts.RefreshCredsOnUploadAuthError || refreshes >= n.opts.MaxCredentialRefreshes || !isUploadAuthError(err) {
+			if ctx.Err() != nil {
+				// The AWS SDK's RequestCanceled error doesn't wrap the context error.
+				err = ctx.Err()
+			}
+			attrs := resp.Data.Attributes
+			return "", "", &UploadError{SubmissionID: resp.Data.ID, Bucket: attrs.Bucket, Object: attrs.Object, Err: err}
+		}
+		infof("Upload failed, retrying with a new submission: %s", err)
+	}
+
+	infof("Successfully uploaded file to S3 location %s", output.Location)
+
+	if n.opts.OnProcessingStart != nil {
+		n.opts.OnProcessingStart(resp.Data.ID)
+	}
+	so.emit(Event{Type: EventProcessingStarted, SubmissionID: resp.Data.ID})
+
+	return resp.Data.ID, output.Location, nil
+}
+
+// Manifest is the record written to ManifestDir for each submission.
+type Manifest struct {
+	// The filename or URL of the artifact.
+	Path           string `json:"path"`
+	SubmissionName string `json:"submissionName"`
+	Sha256         string `json:"sha256"`
+	SubmissionID   string `json:"submissionId"`
+	S3Location     string `json:"s3Location"`
+
+	// The final status, e.g. Accepted or Invalid.
+	Status string `json:"status"`
+
+	// The number of status checks done by this Notarizer, e.g. to tune the PollStrategy.
+	PollCount int `json:"pollCount"`
+}
+
+// writeManifest writes m to ManifestDir as <submission ID>.json, if set.
+func (n *Notarizer) writeManifest(m Manifest) error {
+	if n.opts.ManifestDir == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(n.opts.ManifestDir, 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(n.opts.ManifestDir, m.SubmissionID+".json"), b, 0o644)
+}
+
+// markSubmitted marks checksum as submitted and reports whether it was already marked.
+func (n *Notarizer) markSubmitted(checksum string) bool {
+	n.submittedMu.Lock()
+	defer n.submittedMu.Unlock()
+	if n.submitted[checksum] {
+		return true
+	}
+	n.submitted[checksum] = true
+	return false
+}
+
+// unmarkSubmitted removes checksum from the files submitted.
+func (n *Notarizer) unmarkSubmitted(checksum string) {
+	n.submittedMu.Lock()
+	defer n.submittedMu.Unlock()
+	delete(n.submitted, checksum)
+}
+
+// ResponseInfo holds the metadata of a Notary API response.
+type ResponseInfo struct {
+	// The HTTP status code, e.g. 200.
+	StatusCode int
+
+	// The response headers, e.g. the request ID.
+	Header http.Header
+}
+
+// LastResponse returns the metadata of the last response from the Notary API,
+// successful or not. The zero value is returned if no request has been made.
+// With concurrent submissions, this is the response that arrived last.
+func (n *Notarizer) LastResponse() ResponseInfo {
+	n.lastResponseMu.Lock()
+	defer n.lastResponseMu.Unlock()
+	return ResponseInfo{StatusCode: n.lastResponse.StatusCode, Header: n.lastResponse.Header.Clone()}
+}
+
+// RateLimitInfo is the rate limit reported by Apple in the X-Rate-Limit header,
+// e.g. "user-hour-lim:3500;user-hour-rem:3499;".
+// The App Store Connect API limits the requests per hour and doesn't report when the limit resets.
+type RateLimitInfo struct {
+	// The number of requests allowed per hour.
+	Limit int
+
+	// The number of requests remaining in the current hour.
+	Remaining int
+}
+
+// IsZero reports whether no rate limit was reported.
+func (r RateLimitInfo) IsZero() bool {
+	return r == RateLimitInfo{}
+}
+
+// LastRateLimit returns the rate limit reported in the last response from the Notary API.
+// The zero value is returned if no request has been made or the X-Rate-Limit header was missing.
+func (n *Notarizer) LastRateLimit() RateLimitInfo {
+	n.lastResponseMu.Lock()
+	defer n.lastResponseMu.Unlock()
+	return parseRateLimit(n.lastResponse.Header.Get("X-Rate-Limit"))
+}
+
+// parseRateLimit parses the X-Rate-Limit header, ignoring unknown or malformed parts.
+func parseRateLimit(s string) RateLimitInfo {
+	var info RateLimitInfo
+	for _, part := range strings.Split(s, ";") {
+		k, v, found := strings.Cut(strings.TrimSpace(part), ":")
+		if !found {
+			continue
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		switch k {
+		case "user-hour-lim":
+			info.Limit = i
+		case "user-hour-rem":
+			info.Remaining = i
+		}
+	}
+	return info
+}
+
+// CheckCredentials verifies the credentials and the connection to the Notary API by
+// listing previous submissions, which has no side effects.
+// If the credentials are rejected, errors.Is(err, ErrUnauthorized) is true.
+func (n *Notarizer) CheckCredentials(ctx context.Context) error {
+	return n.checkCredentials(ctx, n.infof)
+}
+
+// checkCredentials is CheckCredentials logging to infof.
+func (n *Notarizer) checkCredentials(ctx context.Context, infof func(format string, a ...any)) error {
+	request, err := n.newAPIRequest(ctx, "GET", n.baseURL, nil)
+	if err != nil {
+		return err
+	}
+	response, body, err := n.doAPIRequest(request)
+	if err != nil {
+		return err
+	}
+	// A drifting clock may be why the token is rejected, so check it first.
+	if err := n.checkClockDriftOnce(response, infof); err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return newAPIError(response, body)
+	}
+	return nil
+}
+
+// Warm prepares for an imminent submission by refreshing the JWT token if needed,
+// connecting to the Notary API (through CheckCredentials) and creating the AWS session,
+// so the submission doesn't pay for it. Calling it is optional.
+func (n *Notarizer) Warm(ctx context.Context) error {
+	if err := n.CheckCredentials(ctx); err != nil {
+		return err
+	}
+	_, err := n.s3BaseSession(ctx, n.infof)
+	return err
+}
+
+// Submission is a notarization submission as listed by ListSubmissions.
+type Submission struct {
+	ID          string
+	Name        string
+	Status      string
+	CreatedDate time.Time
+}
+
+// ListOptions filters the submissions returned by ListSubmissions.
+// The zero value returns all submissions.
+type ListOptions struct {
+	// Only return submissions with this status, e.g. "Invalid".
+	Status string
+
+	// Only return submissions created at or after this time.
+	Since time.Time
+
+	// Return at most this many submissions.
+	Limit int
+}
+
+// ListSubmissions lists the previous submissions for the team, most recent first as returned by Apple.
+// The Notary API doesn't support filtering, so opts is applied on the client.
+func (n *Notarizer) ListSubmissions(ctx context.Context, opts ListOptions) ([]Submission, error) {
+	request, err := n.newAPIRequest(ctx, "GET", n.baseURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, body, err := n.doAPIRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, newAPIError(response, body)
+	}
+
+	var resp submissionListResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var submissions []Submission
+	for _, d := range resp.Data {
+		if opts.Limit > 0 && len(submissions) == opts.Limit {
+			break
+		}
+		attrs := d.Attributes
+		if opts.Status != "" && attrs.Status != opts.Status {
+			continue
+		}
+		if !opts.Since.IsZero() && attrs.CreatedDate.Before(opts.Since) {
+			continue
+		}
+		submissions = append(submissions, Submission{
+			ID:          d.ID,
+			Name:        attrs.Name,
+			Status:      attrs.Status,
+			CreatedDate: attrs.CreatedDate,
+		})
+	}
+
+	return submissions, nil
+}
+
+// pollDelay returns the delay before status check number attempt,
+// clamped to MinPollInterval and MaxPollInterval.
+func (n *Notarizer) pollDelay(attempt int) time.Duration {
+	d := n.opts.PollStrategy.Delay(attempt)
+	if n.opts.MinPollInterval > 0 && d < n.opts.MinPollInterval {
+		d = n.opts.MinPollInterval
+	}
+	if n.opts.MaxPollInterval > 0 && d > n.opts.MaxPollInterval {
+		d = n.opts.MaxPollInterval
+	}
+	return d
+}
+
+// TokenClaims returns a copy of the claims in the current JWT token, e.g. iss, exp and scope.
+func (n *Notarizer) TokenClaims() (jwt.MapClaims, error) {
+	n.tokenMu.Lock()
+	defer n.tokenMu.Unlock()
+	if n.claims == nil {
+		return nil, errors.New("no token created")
+	}
+	claims := make(jwt.MapClaims, len(n.claims))
+	for k, v := range n.claims {
+		claims[k] = v
+	}
+	return claims, nil
+}
+
+// TokenExpiry returns when the current JWT token expires,
+// the zero time if no token has been created.
+func (n *Notarizer) TokenExpiry() time.Time {
+	n.tokenMu.Lock()
+	defer n.tokenMu.Unlock()
+	return n.tokenExpires
+}
+
+// TokenValidFor returns how long the current JWT token is valid for,
+// 0 if it has expired or no token has been created.
+// The token is refreshed shortly before it expires.
+func (n *Notarizer) TokenValidFor() time.Duration {
+	expires := n.TokenExpiry()
+	if expires.IsZero() {
+		return 0
+	}
+	d := time.Until(expires)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// newUploader creates a new S3 uploader using the temporary credentials in attrs.
+func (n *Notarizer) newUploader(ctx context.Context, infof func(format string, a ...any), attrs submissionAttributes) (*s3manager.Uploader, error) {
+	sess, err := n.s3BaseSession(ctx, infof)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &aws.Config{
+		Credentials: credentials.NewStaticCredentials(attrs.AwsAccessKeyID, attrs.AwsSecretAccessKey, attrs.AwsSessionToken),
+	}
+	if attrs.Region != "" {
+		cfg.Region = aws.String(attrs.Region)
+	}
+	if attrs.Endpoint != "" {
+		cfg.Endpoint = aws.String(attrs.Endpoint)
+	}
+	client := s3.New(sess, cfg)
+	uploadOptions := append([]func(*s3manager.Uploader){
+		func(u *s3manager.Uploader) {
+			u.LeavePartsOnError = n.opts.LeavePartsOnError
+		},
+	}, n.opts.UploadOptions...)
+	return s3manager.NewUploaderWithClient(client, uploadOptions...), nil
+}
+
+// createSubmission creates a new submission, returning where to upload the file.
+func (n *Notarizer) createSubmission(ctx context.Context, submissionName, checksum string) (submissionResponse, error) {
+	var resp submissionResponse
+
+	req := &submissionRequest{
+		Sha256:         checksum,
+		SubmissionName: submissionName,
+	}
+
+	var buf bytes.Buffer
+
+	if err := json.NewEncoder(&buf).Encode(req); err != nil {
+		return resp, err
+	}
+
+	request, err := n.newAPIRequest(ctx, "POST", n.baseURL, &buf)
+	if err != nil {
+		return resp, err
+	}
+
+	response, body, err := n.doAPIRequest(request)
+	if err != nil {
+		return resp, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return resp, newAPIError(response, body)
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return resp, err
+	}
+	return resp, resp.validate()
+}
+
+// upload uploads data to the S3 location given in attrs.
+func (n *Notarizer) upload(ctx context.Context, infof func(format string, a ...any), attrs submissionAttributes, format string, data []byte) (*s3manager.UploadOutput, error) {
+	uploader, err := n.newUploader(ctx, infof, attrs)
+	if err != nil {
+		return nil, err
+	}
+	var uploadBody io.ReadSeeker = bytes.NewReader(data)
+	if n.opts.UploadBodyWrapper != nil {
+		uploadBody = n.opts.UploadBodyWrapper(uploadBody)
+	}
+	if n.opts.MaxUploadBytesPerSec > 0 {
+		uploadBody = &throttledReadSeeker{ReadSeeker: uploadBody, ctx: ctx, rate: n.opts.MaxUploadBytesPerSec}
+	}
+
+	input := buildUploadInput(attrs, uploadBody, ContentTypeFor(format))
+	if n.opts.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(n.opts.ServerSideEncryption)
+	}
+	if n.opts.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(n.opts.SSEKMSKeyID)
+	}
+
+	if n.uploadSem != nil {
+		select {
+		case n.uploadSem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		defer func() { <-n.uploadSem }()
+	}
+	return uploader.UploadWithContext(ctx, input)
+}
+
+// throttledReadSeeker limits the average rate of the reads from the ReadSeeker to rate bytes per second.
+type throttledReadSeeker struct {
+	io.ReadSeeker
+	ctx  context.Context
+	rate int64
+
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReadSeeker) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+	// Read in chunks of at most 1/10 second worth of data to keep the rate smooth.
+	if chunk := t.rate / 10; chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.ReadSeeker.Read(p)
+	t.read += int64(n)
+
+	due := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// isUploadAuthError reports whether err is an S3 error caused by
+// invalid credentials or bucket, which a new submission may resolve.
+func isUploadAuthError(err error) bool {
+	var aerr awserr.Error
+	for errors.As(err, &aerr) {
+		switch aerr.Code() {
+		case "AccessDenied", "NoSuchBucket", "InvalidAccessKeyId", "ExpiredToken":
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// buildUploadInput creates the input to upload body to the S3 location given in attrs.
+func buildUploadInput(attrs submissionAttributes, body io.Reader, contentType string) *s3manager.UploadInput {
+	return &s3manager.UploadInput{
+		Bucket:      aws.String(attrs.Bucket),
+		Key:         aws.String(attrs.Object),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	}
+}
+
+// s3BaseSession returns the AWS session shared by all uploads.
+// Apple's credentials differ per submission and are set on each S3 client.
+// Creating the session may fail transiently, e.g. when a credential provider is
+// briefly unavailable, so it's tried a few times. A failure is not cached.
+func (n *Notarizer) s3BaseSession(ctx context.Context, infof func(format string, a ...any)) (*session.Session, error) {
+	const attempts = 3
+	var err error
+	for i := 1; i <= attempts; i++ {
+		var sess *session.Session
+		sess, err = n.newS3BaseSession()
+		if err == nil {
+			return sess, nil
+		}
+		if i < attempts {
+			infof("Warning: failed to create AWS session (attempt %d of %d): %s", i, attempts, err)
+			// Don't hold the lock while waiting.
+			timer := time.NewTimer(sessionRetryDelay * time.Duration(i))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return nil, fmt.Errorf("failed to create AWS session: %w", err)
+}
+
+// newS3BaseSession returns the cached AWS session or tries to create it once.
+func (n *Notarizer) newS3BaseSession() (*session.Session, error) {
+	n.s3SessionMu.Lock()
+	defer n.s3SessionMu.Unlock()
+	if n.s3Session != nil {
+		return n.s3Session, nil
+	}
+
+	s3Config := &aws.Config{
+		Region:     aws.String("us-west-2"),
+		HTTPClient: n.opts.S3HTTPClient,
+	}
+	if s3Config.HTTPClient == nil {
+		// The session may modify the client (e.g. when AWS_CA_BUNDLE is set),
+		// so don't share http.DefaultClient.
+		s3Config.HTTPClient = &http.Client{}
+	}
+	if n.s3Endpoint != "" {
+		s3Config.Endpoint = aws.String(n.s3Endpoint)
+		s3Config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := n.newSession(s3Config)
+	if err != nil {
+		return nil, err
+	}
+	n.s3Session = sess
+	return sess, nil
+}
+
+// sessionRetryDelay is the delay before the first retry of a failed AWS session creation.
+const sessionRetryDelay = 100 * time.Millisecond
+
+// formatSize formats size in bytes in a human readable form, e.g. 680.2 KiB.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGT"[exp])
+}
+
+// validateZip verifies that b is a readable zip archive with no corrupt entries.
+func validateZip(b []byte) error {
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %w", err)
+	}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("corrupt zip entry %q: %w", f.Name, err)
+		}
+		// The checksum is verified when reaching EOF.
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("corrupt zip entry %q: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// newAPIRequest creates a new API request with the JWT signature applied.
+func (n *Notarizer) newAPIRequest(ctx context.Context, method, endpoint string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := n.currentSignature()
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+signature)
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	return request, nil
+
+}
+
+// doAPIRequest performs the API request and returns the response with its body read and closed.
+func (n *Notarizer) doAPIRequest(request *http.Request) (*http.Response, []byte, error) {
+	response, err := n.opts.HTTPClient.Do(request)
+	if err != nil {
+		if request.Context().Err() == nil && isNetworkError(err) {
+			return nil, nil, &NetworkError{Err: err}
+		}
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n.lastResponseMu.Lock()
+	n.lastResponse = ResponseInfo{StatusCode: response.StatusCode, Header: response.Header.Clone()}
+	n.lastResponseMu.Unlock()
+
+	if n.opts.OnAPIExchange != nil {
+		redacted := redactRequest(request)
+		// response.Request is the original request with the Authorization header.
+		resp := *response
+		resp.Request = redacted
+		n.opts.OnAPIExchange(redacted, &resp, redactBody(body))
+	}
+
+	if response.StatusCode == http.StatusOK {
+		// Apple may signal errors in the body with a 200 status.
+		var errResp errorResponse
+		if err := json.Unmarshal(body, &errResp); err == nil && len(errResp.Errors) > 0 {
+			return nil, nil, newAPIError(response, body)
+		}
+	}
+
+	return response, body, nil
+}
+
+// isNetworkError reports whether err, returned from http.Client.Do, means that the
+// server could not be reached. All such errors are a *url.Error implementing net.Error,
+// so look at what it wraps; e.g. a TLS verification failure is not a network error.
+func isNetworkError(err error) bool {
+	var (
+		opErr  *net.OpError
+		dnsErr *net.DNSError
+		netErr net.Error
+	)
+	return errors.As(err, &opErr) || errors.As(err, &dnsErr) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// checkClockDriftOnce runs checkClockDrift on response if CheckClockDrift is set
+// and no check has passed yet. A failed check is not remembered.
+func (n *Notarizer) checkClockDriftOnce(response *http.Response, infof func(format string, a ...any)) error {
+	if !n.opts.CheckClockDrift {
+		return nil
+	}
+	n.clockDriftMu.Lock()
+	defer n.clockDriftMu.Unlock()
+	if n.clockDriftChecked {
+		return nil
+	}
+	if err := n.checkClockDrift(response, infof); err != nil {
+		return err
+	}
+	n.clockDriftChecked = true
+	return nil
+}
+
+// checkClockDriftBeforeSubmit runs the clock drift check through CheckCredentials,
+// which has no side effects, if it's enabled and hasn't passed yet.
+func (n *Notarizer) checkClockDriftBeforeSubmit(ctx context.Context, infof func(format string, a ...any)) error {
+	if !n.opts.CheckClockDrift {
+		return nil
+	}
+	n.clockDriftMu.Lock()
+	checked := n.clockDriftChecked
+	n.clockDriftMu.Unlock()
+	if checked {
+		return nil
+	}
+	return n.checkCredentials(ctx, infof)
+}
+
+// checkClockDrift compares the local clock against the Date header of response.
+func (n *Notarizer) checkClockDrift(response *http.Response, infof func(format string, a ...any)) error {
+	serverTime, err := http.ParseTime(response.Header.Get("Date"))
+	if err != nil {
+		// Nothing to compare against.
+		return nil
+	}
+	drift := time.Since(serverTime)
+	if drift < 0 {
+		drift = -drift
+	}
+	// The Date header has a resolution of one second.
+	if drift <= n.opts.MaxClockDrift+time.Second {
+		return nil
+	}
+	if n.opts.StrictClockDrift {
+		return fmt.Errorf("local clock differs from the Notary API's clock (%s) by %s: %w", serverTime.Format(time.RFC3339), drift.Round(time.Second), ErrClockDrift)
+	}
+	infof("Warning: local clock differs from the Notary API's clock (%s) by %s, the JWT token may be rejected", serverTime.Format(time.RFC3339), drift.Round(time.Second))
+	return nil
+}
+
+// checkStatus returns the status of the submission with the given id,
+// with a *StatusError if it's neither "Accepted" nor "In Progress".
+func (n *Notarizer) checkStatus(ctx context.Context, infof func(format string, a ...any), count int, id string) (string, error) {
+	infof("Checking status (%d)", count)
+	request, err := n.newAPIRequest(ctx, "GET", n.baseURL+"/"+id, nil)
+	if err != nil {
+		return "", err
+	}
+	response, body, err := n.doAPIRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		return "", &SubmissionNotFoundError{ID: id}
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to check status for ID %s: %w", id, newAPIError(response, body))
+	}
+
+	var resp submissionStatusResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+
+	status := resp.Data.Attributes.Status
+	switch status {
+	case "Accepted", "In Progress":
+		return status, nil
+	default:
+		if n.opts.SkipLogFetchOnFailure {
+			return status, &StatusError{ID: id, Status: status}
+		}
+		logURL, logErr := n.printLogInfo(ctx, infof, id)
+		if logErr == nil && n.opts.OnLogAvailable != nil {
+			n.opts.OnLogAvailable(id, logURL)
+		}
+		return status, &StatusError{ID: id, Status: status, LogURL: logURL, LogErr: logErr}
+	}
 }
 
-type submissionResponse struct {
+// LogURL fetches the URL of the developer log for the submission with the given ID.
+// It does not call OnLogAvailable.
+func (n *Notarizer) LogURL(ctx context.Context, id string) (string, error) {
+	infof := func(format string, a ...any) {
+		n.infof("[%s] "+format, append([]any{id}, a...)...)
+	}
+	return n.printLogInfo(ctx, infof, id)
+}
+
+// printLogInfo prints some information about where to download the logs from and returns the log URL.
+func (n *Notarizer) printLogInfo(ctx context.Context, infof func(format string, a ...any), id string) (string, error) {
+	infof("Fetching logs")
+	request, err := n.newAPIRequest(ctx, "GET", n.baseURL+"/"+id+"/logs", nil)
+	if err != nil {
+		return "", err
+	}
+	response, body, err := n.doAPIRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch logs with ID %s: %w", id, newAPIError(response, body))
+	}
+
+	var resp logsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+
+	infof("Logs can be found at %s", resp.Data.Attributes.DeveloperLogURL)
+
+	return resp.Data.Attributes.DeveloperLogURL, nil
+}
+
+// reservedClaims are the JWT claims that can not be set in ExtraClaims.
+var reservedClaims = map[string]bool{
+	"iss": true,
+	"iat": true,
+	"exp": true,
+	"aud": true,
+	// Replacing the scope would drop /notary/v2.
+	"scope": true,
+}
+
+// normalizeClaims gives claims parsed from a cached token the same types as the
+// claims of a token created by createAndSignToken, e.g. int64 instead of float64 for exp.
+func (n *Notarizer) normalizeClaims(claims jwt.MapClaims) {
+	for _, k := range []string{"iat", "exp"} {
+		if f, ok := claims[k].(float64); ok {
+			claims[k] = int64(f)
+		}
+	}
+	if scope, ok := claims["scope"].([]any); ok {
+		ss := make([]string, 0, len(scope))
+		for _, v := range scope {
+			if s, ok := v.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		claims["scope"] = ss
+	}
+	// The cache key includes the ExtraClaims, so they're the same.
+	for k, v := range n.opts.ExtraClaims {
+		claims[k] = v
+	}
+}
+
+// tokenCacheKey returns the TokenCache key for the tokens created with opts.
+// Tokens with different ExtraClaims are not shared.
+func tokenCacheKey(opts Options) (string, error) {
+	key := opts.IssuerID + "/" + opts.Kid + "/" + opts.Audience
+	if len(opts.ExtraClaims) == 0 {
+		return key, nil
+	}
+	// Map keys are sorted by json.Marshal.
+	extra, err := json.Marshal(opts.ExtraClaims)
+	if err != nil {
+		return "", fmt.Errorf("ExtraClaims: %w", err)
+	}
+	return key + "/" + string(extra), nil
+}
+
+// tokenRefreshMargin is how long before expiry a token gets replaced.
+const tokenRefreshMargin = time.Minute
+
+// currentSignature returns the signed JWT token, creating a new one if it's about to expire.
+func (n *Notarizer) currentSignature() (string, error) {
+	n.tokenMu.Lock()
+	defer n.tokenMu.Unlock()
+	if time.Until(n.tokenExpires) < tokenRefreshMargin {
+		if err := n.refreshTokenLocked(); err != nil {
+			return "", err
+		}
+	}
+	return n.signature, nil
+}
+
+// refreshTokenLocked replaces the current token with one from the TokenCache or a newly signed one.
+// The caller must hold tokenMu.
+func (n *Notarizer) refreshTokenLocked() error {
+	cache := n.opts.TokenCache
+	cacheKey, err := tokenCacheKey(n.opts)
+	if err != nil {
+		return err
+	}
+
+	if cache != nil {
+		if signature, expires, found := cache.Get(cacheKey); found && time.Until(expires) >= tokenRefreshMargin {
+			claims := jwt.MapClaims{}
+			if _, _, err := jwt.NewParser().ParseUnverified(signature, claims); err == nil {
+				n.normalizeClaims(claims)
+				n.signature = signature
+				n.claims = claims
+				n.tokenExpires = expires
+				return nil
+			}
+		}
+	}
+
+	tok, signature, err := n.createAndSignToken()
+	if err != nil {
+		return err
+	}
+	claims := tok.Claims.(jwt.MapClaims)
+	n.signature = signature
+	n.claims = claims
+	n.tokenExpires = time.Unix(claims["exp"].(int64), 0)
+
+	if cache != nil {
+		cache.Set(cacheKey, signature, n.tokenExpires)
+	}
+
+	return nil
+}
+
+// SubmissionStore stores submission IDs by key, see Options.SubmissionStore.
+// Implementations must be safe for concurrent use.
+type SubmissionStore interface {
+	// Get returns the submission ID stored for key.
+	Get(key string) (id string, found bool, err error)
+
+	// Put stores the submission ID for key.
+	Put(key, id string) error
+
+	// Delete removes the submission ID stored for key, if any.
+	Delete(key string) error
+}
+
+// NewMemorySubmissionStore creates a new in-memory SubmissionStore, safe for concurrent use.
+func NewMemorySubmissionStore() SubmissionStore {
+	return &memorySubmissionStore{ids: make(map[string]string)}
+}
+
+type memorySubmissionStore struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func (s *memorySubmissionStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, found := s.ids[key]
+	return id, found, nil
+}
+
+func (s *memorySubmissionStore) Put(key, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[key] = id
+	return nil
+}
+
+func (s *memorySubmissionStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ids, key)
+	return nil
+}
+
+// NewFileSubmissionStore creates a new SubmissionStore backed by the JSON file filename,
+// which is created on the first Put.
+// It's safe for concurrent use within one process.
+func NewFileSubmissionStore(filename string) SubmissionStore {
+	return &fileSubmissionStore{filename: filename}
+}
+
+type fileSubmissionStore struct {
+	mu       sync.Mutex
+	filename string
+}
+
+func (s *fileSubmissionStore) Get(key string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.read()
+	if err != nil {
+		return "", false, err
+	}
+	id, found := ids[key]
+	return id, found, nil
+}
+
+func (s *fileSubmissionStore) Put(key, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.read()
+	if err != nil {
+		return err
+	}
+	ids[key] = id
+	return s.write(ids)
+}
+
+func (s *fileSubmissionStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, found := ids[key]; !found {
+		return nil
+	}
+	delete(ids, key)
+	return s.write(ids)
+}
+
+func (s *fileSubmissionStore) write(ids map[string]string) error {
+	b, err := json.MarshalIndent(ids, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.filename, b, 0o644)
+}
+
+func (s *fileSubmissionStore) read() (map[string]string, error) {
+	ids := make(map[string]string)
+	b, err := os.ReadFile(s.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ids, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.filename, err)
+	}
+	return ids, nil
+}
+
+// TokenCache caches signed JWT tokens so they can be shared between Notarizers.
+// Tokens are cached per issuer ID, key ID, audience and ExtraClaims.
+// Implementations must be safe for concurrent use.
+type TokenCache interface {
+	// Get returns the token cached for key and when it expires.
+	Get(key string) (token string, expires time.Time, found bool)
+
+	// Set caches token for key until it expires.
+	Set(key, token string, expires time.Time)
+}
+
+// NewMemoryTokenCache creates a new in-memory TokenCache, safe for concurrent use.
+func NewMemoryTokenCache() TokenCache {
+	return &memoryTokenCache{tokens: make(map[string]cachedToken)}
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+type memoryTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken
+}
+
+func (c *memoryTokenCache) Get(key string) (string, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, found := c.tokens[key]
+	return t.token, t.expires, found
+}
+
+func (c *memoryTokenCache) Set(key, token string, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[key] = cachedToken{token: token, expires: expires}
+}
+
+func (n *Notarizer) createAndSignToken() (*jwt.Token, string, error) {
+	exp := time.Now().Add(n.opts.TokenTimeout).UTC().Unix()
+	iat := time.Now().UTC().Unix()
+
+	claims := jwt.MapClaims{
+		"iss": n.opts.IssuerID,
+		// The token’s creation time, in UNIX epoch time; for example, 1528407600.
+		"iat": iat,
+		// The token’s expiration time in Unix epoch time.
+		"exp": exp,
+		// Audience.
+		"aud": n.opts.Audience,
+		// A list of operations you want App Store Connect to allow for this token.
+		"scope": []string{"/notary/v2"},
+	}
+	for k, v := range n.opts.ExtraClaims {
+		claims[k] = v
+	}
+
+	method := jwt.SigningMethodES256
+	tok := &jwt.Token{
+		Header: map[string]interface{}{
+			"alg": method.Alg(),
+			"kid": n.opts.Kid,
+			"typ": "JWT",
+		},
+		Claims: claims,
+		Method: method,
+	}
+
+	signature, err := n.opts.SignFunc(tok)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tok, signature, nil
+}
+
+// StatusError is returned when a submission ends with another status than Accepted, e.g. Invalid.
+type StatusError struct {
+	// The submission ID.
+	ID string
+
+	// The status reported by Apple.
+	Status string
+
+	// The URL of the developer log with the details, empty if it could not be fetched.
+	LogURL string
+
+	// The error from fetching the log URL, if any.
+	LogErr error
+}
+
+// Error returns the status, the submission ID and the log URL in a stable format, e.g.
+//
+//	unexpected status: Invalid for submission 2efe2717-52ef-43a5-96dc-0797e4ca1041 (log: https://...)
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("unexpected status: %s for submission %s", e.Status, e.ID)
+	if e.LogURL != "" {
+		msg += fmt.Sprintf(" (log: %s)", e.LogURL)
+	}
+	if e.LogErr != nil {
+		msg += fmt.Sprintf(" (failed to fetch logs: %s)", e.LogErr)
+	}
+	return msg
+}
+
+// Unwrap returns the error from fetching the logs, if any.
+func (e *StatusError) Unwrap() error {
+	return e.LogErr
+}
+
+// UploadError is returned when the upload to S3 fails or is cancelled, e.g. through the context.
+// The submission is left as is with Apple, waiting for the file to be uploaded
+// to Bucket/Object, e.g. by another tool, after which its status can be checked
+// using SubmissionID. Apple's temporary S3 credentials are not included.
+type UploadError struct {
+	// The ID of the submission waiting for the upload.
+	SubmissionID string
+
+	// The S3 location of the upload.
+	Bucket string
+	Object string
+
+	// The upload error, e.g. context.Canceled.
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload of submission %s to s3://%s/%s failed: %s", e.SubmissionID, e.Bucket, e.Object, e.Err)
+}
+
+// Unwrap returns the upload error.
+func (e *UploadError) Unwrap() error {
+	return e.Err
+}
+
+// NetworkError is returned when the Notary API could not be reached.
+type NetworkError struct {
+	// The underlying error, e.g. a *url.Error.
+	Err error
+}
+
+func (e *NetworkError) Error() string {
+	return fmt.Sprintf("failed to reach the Notary API, check the network connection and any proxy settings: %s", e.Err)
+}
+
+// Is reports whether target is ErrNetwork.
+func (e *NetworkError) Is(target error) bool {
+	return target == ErrNetwork
+}
+
+// Unwrap returns the underlying error.
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// SubmissionNotFoundError is returned when the Notary API responds with
+// 404 Not Found to a status check.
+type SubmissionNotFoundError struct {
+	// The submission ID.
+	ID string
+}
+
+func (e *SubmissionNotFoundError) Error() string {
+	return fmt.Sprintf("submission %s not found", e.ID)
+}
+
+// Is reports whether target is ErrSubmissionNotFound.
+func (e *SubmissionNotFoundError) Is(target error) bool {
+	return target == ErrSubmissionNotFound
+}
+
+// APIError is returned when the Notary API responds with a list of errors.
+type APIError struct {
+	// The HTTP status code of the response.
+	StatusCode int
+
+	// The errors in the response body.
+	Errors []APIErrorItem
+}
+
+// newAPIError creates an APIError from response and its body.
+func newAPIError(response *http.Response, body []byte) *APIError {
+	var errResp errorResponse
+	// The body may not be JSON, e.g. from a proxy.
+	_ = json.Unmarshal(body, &errResp)
+	return &APIError{StatusCode: response.StatusCode, Errors: errResp.Errors}
+}
+
+// Is reports whether the error matches target, which is true for ErrUnauthorized on a 401 response.
+func (e *APIError) Is(target error) bool {
+	return target == ErrUnauthorized && e.StatusCode == http.StatusUnauthorized
+}
+
+func (e *APIError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("notary API responded with status %d", e.StatusCode)
+	}
+	msgs := make([]string, len(e.Errors))
+	for i, item := range e.Errors {
+		msgs[i] = item.String()
+	}
+	return fmt.Sprintf("notary API responded with status %d: %s", e.StatusCode, strings.Join(msgs, "; "))
+}
+
+// APIErrorItem is an error as reported by the App Store Connect API.
+type APIErrorItem struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func (e APIErrorItem) String() string {
+	var parts []string
+	for _, part := range []string{e.Code, e.Title, e.Detail} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ": ")
+}
+
+type errorResponse struct {
+	Errors []APIErrorItem `json:"errors"`
+}
+
+const redacted = "REDACTED"
+
+// redactRequest returns a copy of req with the Authorization header redacted.
+func redactRequest(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	if r.Header.Get("Authorization") != "" {
+		r.Header.Set("Authorization", redacted)
+	}
+	return r
+}
+
+// secretFields are the JSON fields in the API responses that must never be exposed.
+var secretFields = map[string]bool{
+	"awsAccessKeyId":     true,
+	"awsSecretAccessKey": true,
+	"awsSessionToken":    true,
+}
+
+// redactBody returns body with the values of any secretFields redacted.
+func redactBody(body []byte) []byte {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		// Not JSON, so it can't contain any of our secrets.
+		return body
+	}
+	if !redactValue(v) {
+		return body
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+func redactValue(v any) bool {
+	var found bool
+	switch vv := v.(type) {
+	case map[string]any:
+		for k, e := range vv {
+			if secretFields[k] {
+				vv[k] = redacted
+				found = true
+				continue
+			}
+			if redactValue(e) {
+				found = true
+			}
+		}
+	case []any:
+		for _, e := range vv {
+			if redactValue(e) {
+				found = true
+			}
+		}
+	}
+	return found
+}
+
+type logsResponse struct {
 	Data struct {
-		Type       string `json:"type"`
 		ID         string `json:"id"`
+		Type       string `json:"type"`
 		Attributes struct {
-			AwsAccessKeyID     string `json:"awsAccessKeyId"`
-			AwsSecretAccessKey string `json:"awsSecretAccessKey"`
-			AwsSessionToken    string `json:"awsSessionToken"`
-			Bucket             string `json:"bucket"`
-			Object             string `json:"object"`
+			DeveloperLogURL string `json:"developerLogUrl"`
 		} `json:"attributes"`
 	} `json:"data"`
 	Meta struct {
 	} `json:"meta"`
 }
 
-type submissionStatusResponse struct {
+type submissionRequest struct {
+	Sha256         string `json:"sha256"`
+	SubmissionName string `json:"submissionName"`
+}
+
+type submissionResponse struct {
 	Data struct {
-		ID         string `json:"id"`
-		Type       string `json:"type"`
-		Attributes struct {
-			Status      string    `json:"status"`
-			Name        string    `json:"name"`
-			CreatedDate time.Time `json:"createdDate"`
-		} `json:"attributes"`
+		Type       string               `json:"type"`
+		ID         string               `json:"id"`
+		Attributes submissionAttributes `json:"attributes"`
 	} `json:"data"`
 	Meta struct {
 	} `json:"meta"`
 }
+
+// validate checks that the fields needed to upload the file are set,
+// e.g. to catch a field renamed by Apple.
+func (r submissionResponse) validate() error {
+	attrs := r.Data.Attributes
+	for _, f := range []struct {
+		name  string
+		value string
+	}{
+		{"id", r.Data.ID},
+		{"awsAccessKeyId", attrs.AwsAccessKeyID},
+		{"awsSecretAccessKey", attrs.AwsSecretAccessKey},
+		{"bucket", attrs.Bucket},
+		{"object", attrs.Object},
+	} {
+		if f.value == "" {
+			return fmt.Errorf("the response from Apple is missing %q", f.name)
+		}
+	}
+	return nil
+}
+
+type submissionAttributes struct {
+	AwsAccessKeyID     string `json:"awsAccessKeyId"`
+	AwsSecretAccessKey string `json:"awsSecretAccessKey"`
+	AwsSessionToken    string `json:"awsSessionToken"`
+	Bucket             string `json:"bucket"`
+	Object             string `json:"object"`
+
+	// Apple doesn't currently send these, but if it does, they're preferred
+	// over the default region and endpoint.
+	Region   string `json:"region,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// submissionStatusResponse is the status of a submission as a whole;
+// Apple's API doesn't report the status of the individual binaries in it.
+type submissionStatusResponse struct {
+	Data submissionData `json:"data"`
+	Meta struct {
+	} `json:"meta"`
+}
+
+type submissionListResponse struct {
+	Data []submissionData `json:"data"`
+	Meta struct {
+	} `json:"meta"`
+}
+
+type submissionData struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Attributes struct {
+		Status      string    `json:"status"`
+		Name        string    `json:"name"`
+		CreatedDate time.Time `json:"createdDate"`
+	} `json:"attributes"`
+}
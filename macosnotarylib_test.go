@@ -1,10 +1,39 @@
 package macosnotarylib
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/bep/macosnotarylib/notarytest"
 	qt "github.com/frankban/quicktest"
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -44,3 +73,2488 @@ func TestNotarizeZip(t *testing.T) {
 	c.Assert(err, qt.IsNil)
 
 }
+
+func TestOptionsFromJSON(t *testing.T) {
+	c := qt.New(t)
+
+	key, keyPath := writeTestKey(c)
+
+	config := fmt.Sprintf(`{"issuerId": "57246542-96fe-1a63-e053-0824d011072a", "keyId": "ABC123", "keyPath": %q}`, keyPath)
+	opts, err := OptionsFromJSON(strings.NewReader(config))
+	c.Assert(err, qt.IsNil)
+	c.Assert(opts.IssuerID, qt.Equals, "57246542-96fe-1a63-e053-0824d011072a")
+	c.Assert(opts.Kid, qt.Equals, "ABC123")
+
+	signed, err := opts.SignFunc(jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": opts.IssuerID}))
+	c.Assert(err, qt.IsNil)
+	_, err = jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil })
+	c.Assert(err, qt.IsNil)
+
+	_, err = OptionsFromJSON(strings.NewReader(`{"issuerId": "57246542-96fe-1a63-e053-0824d011072a", "keyPath": "AuthKey.p8"}`))
+	c.Assert(err, qt.ErrorMatches, "keyId is required")
+}
+
+func TestEncodeKeyForEnv(t *testing.T) {
+	c := qt.New(t)
+
+	key, keyPath := writeTestKey(c)
+
+	encoded, err := EncodeKeyForEnv(keyPath)
+	c.Assert(err, qt.IsNil)
+	c.Setenv("MACOSNOTARYLIB_TEST_PRIVATE_KEY", encoded)
+
+	decoded, err := LoadPrivateKeyFromEnvBase64("MACOSNOTARYLIB_TEST_PRIVATE_KEY")
+	c.Assert(err, qt.IsNil)
+	c.Assert(decoded.Equal(key), qt.IsTrue)
+
+	_, err = EncodeKeyForEnv("testdata/helloworld.go")
+	c.Assert(err, qt.ErrorMatches, "testdata/helloworld.go: .*")
+}
+
+func TestLoadPrivateKeyFromEncryptedPEM(t *testing.T) {
+	c := qt.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, qt.IsNil)
+
+	//lint:ignore SA1019 testing the legacy format.
+	block, err := x509.EncryptPEMBlock(rand.Reader, "PRIVATE KEY", der, []byte("secret"), x509.PEMCipherAES256)
+	c.Assert(err, qt.IsNil)
+	encrypted := pem.EncodeToMemory(block)
+
+	decoded, err := LoadPrivateKeyFromEncryptedPEM(encrypted, "secret")
+	c.Assert(err, qt.IsNil)
+	c.Assert(decoded.Equal(key), qt.IsTrue)
+
+	_, err = LoadPrivateKeyFromEncryptedPEM(encrypted, "wrong")
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	_, err = LoadPrivateKeyFromEncryptedPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), "secret")
+	c.Assert(err, qt.ErrorMatches, `PEM block "PRIVATE KEY" is not encrypted`)
+
+	_, err = LoadPrivateKeyFromEncryptedPEM([]byte("foo"), "secret")
+	c.Assert(err, qt.ErrorMatches, "no PEM block found")
+}
+
+// writeTestKey generates a P-256 key and writes it in .p8 format to a temporary file.
+func writeTestKey(c *qt.C) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	c.Assert(err, qt.IsNil)
+	keyPath := filepath.Join(c.TempDir(), "AuthKey.p8")
+	c.Assert(os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600), qt.IsNil)
+	return key, keyPath
+}
+
+func TestSupportedFormats(t *testing.T) {
+	c := qt.New(t)
+
+	formats := SupportedFormats()
+	c.Assert(formats, qt.DeepEquals, []string{FormatDMG, FormatPkg, FormatZip})
+	for _, format := range formats {
+		_, found := contentTypes[formatFromFilename("helloworld."+strings.ToUpper(format))]
+		c.Assert(found, qt.IsTrue, qt.Commentf(format))
+	}
+
+	// The returned slice is a copy.
+	formats[0] = "exe"
+	c.Assert(SupportedFormats()[0], qt.Equals, FormatDMG)
+}
+
+func TestContentTypeFor(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		filename string
+		expect   string
+	}{
+		{"helloworld.zip", "application/zip"},
+		{"Hello World.dmg", "application/x-apple-diskimage"},
+		{"helloworld.pkg", "application/octet-stream"},
+		{"HELLOWORLD.ZIP", "application/zip"},
+		{"helloworld.tar.gz", "application/octet-stream"},
+	} {
+		c.Assert(ContentTypeFor(formatFromFilename(test.filename)), qt.Equals, test.expect, qt.Commentf(test.filename))
+	}
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+
+	srv := newFakeServer(c)
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		srv.handleUpload(w, r)
+	}
+
+	opts := newTestOptions()
+	opts.MaxConcurrentUploads = 1
+	n := srv.newNotarizer(c, opts)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(maxSeen, qt.Equals, 1)
+	c.Assert(srv.uploads(), qt.HasLen, 3)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	c := qt.New(t)
+
+	started := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	srv := newFakeServer(c)
+	srv.submit = func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-unblock
+		srv.handleSubmit(w, r)
+	}
+
+	opts := newTestOptions()
+	opts.MaxConcurrency = 1
+	n := srv.newNotarizer(c, opts)
+
+	errc := make(chan error, 2)
+	submit := func() { errc <- n.Submit("testdata/helloworld.zip") }
+	go submit()
+	<-started
+	go submit()
+
+	// The second submission waits for the first to complete.
+	select {
+	case <-started:
+		c.Fatal("second submission started before the first completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	c.Assert(<-errc, qt.IsNil)
+	c.Assert(<-errc, qt.IsNil)
+	c.Assert(srv.submissions, qt.HasLen, 2)
+
+	c.Run("Canceled while waiting", func(c *qt.C) {
+		n.submitSem <- struct{}{}
+		defer func() { <-n.submitSem }()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		c.Assert(n.SubmitContext(ctx, "testdata/helloworld.zip"), qt.Equals, context.DeadlineExceeded)
+	})
+}
+
+func TestOnAPIExchange(t *testing.T) {
+	c := qt.New(t)
+
+	var (
+		mu        sync.Mutex
+		exchanges []string
+	)
+
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.OnAPIExchange = func(req *http.Request, resp *http.Response, body []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		c.Check(req.Header.Get("Authorization"), qt.Equals, "REDACTED")
+		c.Check(resp.Request.Header.Get("Authorization"), qt.Equals, "REDACTED")
+		c.Check(resp.StatusCode, qt.Equals, http.StatusOK)
+		for _, secret := range []string{"AKIAEXAMPLE", "secret", "session"} {
+			c.Check(string(body), qt.Not(qt.Contains), secret)
+		}
+		exchanges = append(exchanges, req.Method+" "+req.URL.Path)
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(exchanges, qt.DeepEquals, []string{
+		"POST /notary/v2/submissions",
+		"GET /notary/v2/submissions/submission-1",
+	})
+}
+
+func TestInvalidIssuerID(t *testing.T) {
+	c := qt.New(t)
+
+	for _, issuerID := range []string{
+		"",
+		"57246542-96fe-1a63-e053-0824d011072",
+		"57246542-96fe-1a63-e053-0824d011072a1",
+		"5724654296fe1a63e0530824d011072a",
+		"57246542_96fe_1a63_e053_0824d011072a",
+		"5724654g-96fe-1a63-e053-0824d011072a",
+		"ABC123",
+		" 57246542-96fe-1a63-e053-0824d011072a",
+	} {
+		opts := newTestOptions()
+		opts.IssuerID = issuerID
+		_, err := New(opts)
+		c.Assert(errors.Is(err, ErrInvalidIssuerID), qt.IsTrue, qt.Commentf("%q", issuerID))
+		c.Assert(err, qt.ErrorMatches, "invalid issuer ID "+regexp.QuoteMeta(fmt.Sprintf("%q", issuerID))+", expected a UUID.*")
+	}
+
+	opts := newTestOptions()
+	opts.IssuerID = "57246542-96FE-1A63-E053-0824D011072A"
+	_, err := New(opts)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestTokenClaims(t *testing.T) {
+	c := qt.New(t)
+
+	n, err := New(newTestOptions())
+	c.Assert(err, qt.IsNil)
+
+	claims, err := n.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["iss"], qt.Equals, "57246542-96fe-1a63-e053-0824d011072a")
+	c.Assert(claims["aud"], qt.Equals, "appstoreconnect-v1")
+	c.Assert(claims["scope"], qt.DeepEquals, []string{"/notary/v2"})
+}
+
+func TestTokenExpiry(t *testing.T) {
+	c := qt.New(t)
+
+	opts := newTestOptions()
+	opts.TokenTimeout = 10 * time.Minute
+	start := time.Now().Truncate(time.Second)
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+
+	expires := n.TokenExpiry()
+	c.Assert(expires.Sub(start) >= opts.TokenTimeout, qt.IsTrue, qt.Commentf("%s", expires.Sub(start)))
+	c.Assert(expires.Sub(start) <= opts.TokenTimeout+time.Second, qt.IsTrue, qt.Commentf("%s", expires.Sub(start)))
+
+	validFor := n.TokenValidFor()
+	c.Assert(validFor > opts.TokenTimeout-time.Second, qt.IsTrue, qt.Commentf("%s", validFor))
+	c.Assert(validFor <= opts.TokenTimeout, qt.IsTrue, qt.Commentf("%s", validFor))
+
+	var zero Notarizer
+	c.Assert(zero.TokenExpiry().IsZero(), qt.IsTrue)
+	c.Assert(zero.TokenValidFor(), qt.Equals, time.Duration(0))
+}
+
+func TestSubmissionTimeoutNegativeWaitsIndefinitely(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "In Progress", "In Progress", "Accepted"}
+	opts := newTestOptions()
+	opts.SubmissionTimeout = -1
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(srv.polls, qt.Equals, 4)
+}
+
+func TestValidateArchive(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	c.Assert(validateZip(b), qt.IsNil)
+
+	truncated := filepath.Join(c.TempDir(), "truncated.zip")
+	c.Assert(os.WriteFile(truncated, b[:len(b)/2], 0o644), qt.IsNil)
+
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.ValidateArchive = true
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit(truncated), qt.ErrorMatches, ".*truncated.zip: invalid zip archive.*")
+	c.Assert(srv.submissions, qt.HasLen, 0)
+
+	// The format is taken from the file, not the submission name.
+	c.Assert(n.Submit(truncated, WithCallName("truncated build 42")), qt.ErrorMatches, ".*truncated build 42: invalid zip archive.*")
+	c.Assert(srv.submissions, qt.HasLen, 0)
+
+	var contentType string
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		srv.handleUpload(w, r)
+	}
+	c.Assert(n.Submit("testdata/helloworld.zip", WithCallName("helloworld build 42")), qt.IsNil)
+	c.Assert(contentType, qt.Equals, "application/zip")
+
+	// Flip a byte in the compressed data of the first entry.
+	corrupt := append([]byte(nil), b...)
+	corrupt[100] ^= 0xff
+	c.Assert(validateZip(corrupt), qt.ErrorMatches, `corrupt zip entry "helloworld".*`)
+}
+
+func TestUploadOptions(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	opts := newTestOptions()
+	opts.UploadOptions = []func(*s3manager.Uploader){
+		func(u *s3manager.Uploader) {
+			calls++
+			u.PartSize = 10 * 1024 * 1024
+		},
+	}
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+
+	uploader, err := n.newUploader(context.Background(), n.infof, submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE", AwsSecretAccessKey: "secret"})
+	c.Assert(err, qt.IsNil)
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(uploader.PartSize, qt.Equals, int64(10*1024*1024))
+}
+
+func TestSmallFileSinglePartUpload(t *testing.T) {
+	c := qt.New(t)
+
+	var requests []string
+	srv := newFakeServer(c)
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		srv.handleUpload(w, r)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	// Files smaller than the uploader's PartSize (5 MiB by default) are
+	// uploaded with a single PutObject, not a multipart upload.
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(requests, qt.DeepEquals, []string{"PUT /notary-submissions/prod/submission-1"})
+}
+
+func TestDuplicateSubmission(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	copied := filepath.Join(c.TempDir(), "helloworld-copy.zip")
+	c.Assert(os.WriteFile(copied, b, 0o644), qt.IsNil)
+
+	c.Run("Warn", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts, logs := newTestOptionsWithLog()
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(logs.String(), qt.Not(qt.Contains), "already been submitted")
+		c.Assert(n.Submit(copied), qt.IsNil)
+		c.Assert(logs.String(), qt.Contains, "[helloworld-copy.zip] Warning: file with checksum")
+		c.Assert(srv.submissions, qt.HasLen, 2)
+	})
+
+	c.Run("Reject", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.RejectDuplicates = true
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		err := n.Submit(copied)
+		c.Assert(errors.Is(err, ErrDuplicateSubmission), qt.IsTrue)
+		c.Assert(srv.submissions, qt.HasLen, 1)
+	})
+
+	c.Run("Retry after upload failure", func(c *qt.C) {
+		srv := newFakeServer(c)
+		var failed bool
+		srv.upload = func(w http.ResponseWriter, r *http.Request) {
+			if !failed {
+				failed = true
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+				return
+			}
+			srv.handleUpload(w, r)
+		}
+		opts := newTestOptions()
+		opts.RejectDuplicates = true
+		n := srv.newNotarizer(c, opts)
+
+		var uploadErr *UploadError
+		c.Assert(errors.As(n.Submit("testdata/helloworld.zip"), &uploadErr), qt.IsTrue)
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(srv.submissions, qt.HasLen, 2)
+
+		// The successful submission is still recorded.
+		c.Assert(errors.Is(n.Submit(copied), ErrDuplicateSubmission), qt.IsTrue)
+	})
+}
+
+func TestUploadBodyWrapper(t *testing.T) {
+	c := qt.New(t)
+
+	var tee *teeReadSeeker
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.UploadBodyWrapper = func(r io.ReadSeeker) io.ReadSeeker {
+		tee = &teeReadSeeker{ReadSeeker: r}
+		return tee
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	c.Assert(tee, qt.Not(qt.IsNil))
+	c.Assert(bytes.Equal(tee.buf.Bytes(), b), qt.IsTrue)
+	c.Assert(bytes.Equal(srv.uploads()["/notary-submissions/prod/submission-1"], b), qt.IsTrue)
+}
+
+func TestMaxUploadBytesPerSec(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Reader", func(c *qt.C) {
+		const size, rate = 100 * 1024, 400 * 1024
+		r := &throttledReadSeeker{ReadSeeker: bytes.NewReader(make([]byte, size)), ctx: context.Background(), rate: rate}
+		start := time.Now()
+		n, err := io.Copy(io.Discard, r)
+		elapsed := time.Since(start)
+		c.Assert(err, qt.IsNil)
+		c.Assert(n, qt.Equals, int64(size))
+		want := time.Second * size / rate
+		c.Assert(elapsed >= want*9/10, qt.IsTrue, qt.Commentf("%s", elapsed))
+		c.Assert(elapsed < want*2, qt.IsTrue, qt.Commentf("%s", elapsed))
+
+		// Still seekable.
+		pos, err := r.Seek(0, io.SeekStart)
+		c.Assert(err, qt.IsNil)
+		c.Assert(pos, qt.Equals, int64(0))
+	})
+
+	c.Run("Submit", func(c *qt.C) {
+		fi, err := os.Stat("testdata/helloworld.zip")
+		c.Assert(err, qt.IsNil)
+
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.MaxUploadBytesPerSec = 4 << 20
+		n := srv.newNotarizer(c, opts)
+
+		start := time.Now()
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		want := time.Duration(fi.Size()) * time.Second / time.Duration(opts.MaxUploadBytesPerSec)
+		c.Assert(time.Since(start) >= want*9/10, qt.IsTrue)
+		c.Assert(srv.uploads()["/notary-submissions/prod/submission-1"], qt.HasLen, int(fi.Size()))
+	})
+
+	c.Run("Cancel", func(c *qt.C) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := &throttledReadSeeker{ReadSeeker: bytes.NewReader(make([]byte, 1024)), ctx: ctx, rate: 1}
+		_, err := r.Read(make([]byte, 1024))
+		c.Assert(err, qt.Equals, context.Canceled)
+	})
+}
+
+// teeReadSeeker copies everything read to buf, starting over when seeking to the start.
+type teeReadSeeker struct {
+	io.ReadSeeker
+	buf bytes.Buffer
+}
+
+func (t *teeReadSeeker) Read(p []byte) (int, error) {
+	n, err := t.ReadSeeker.Read(p)
+	t.buf.Write(p[:n])
+	return n, err
+}
+
+func (t *teeReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := t.ReadSeeker.Seek(offset, whence)
+	if err == nil && pos == 0 {
+		t.buf.Reset()
+	}
+	return pos, err
+}
+
+func TestOnSubmissionCreated(t *testing.T) {
+	c := qt.New(t)
+
+	var events []string
+	srv := newFakeServer(c)
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, "upload")
+		srv.handleUpload(w, r)
+	}
+	opts := newTestOptions()
+	opts.OnSubmissionCreated = func(id string) {
+		events = append(events, "created "+id)
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(events, qt.DeepEquals, []string{"created submission-1", "upload"})
+}
+
+func TestOnProcessingStart(t *testing.T) {
+	c := qt.New(t)
+
+	var events []string
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "Accepted"}
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, "upload")
+		srv.handleUpload(w, r)
+	}
+	opts := newTestOptions()
+	opts.OnProcessingStart = func(id string) {
+		events = append(events, "processing "+id)
+	}
+	opts.OnAPIExchange = func(req *http.Request, resp *http.Response, body []byte) {
+		if req.Method == "GET" && strings.HasSuffix(req.URL.Path, "/submission-1") {
+			events = append(events, "poll")
+		}
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(events, qt.DeepEquals, []string{"upload", "processing submission-1", "poll", "poll"})
+}
+
+func TestSubmitWithProgress(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "Accepted"}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	events, errc := n.SubmitWithProgress(context.Background(), "testdata/helloworld.zip")
+	var got []string
+	for e := range events {
+		c.Assert(e.SubmissionID, qt.Equals, "submission-1")
+		s := e.Type.String()
+		if e.Status != "" {
+			s += " " + e.Status
+		}
+		got = append(got, s)
+	}
+	c.Assert(<-errc, qt.IsNil)
+	_, ok := <-errc
+	c.Assert(ok, qt.IsFalse)
+
+	c.Assert(got, qt.DeepEquals, []string{
+		"SubmissionCreated",
+		"UploadStarted",
+		"ProcessingStarted",
+		"Status In Progress",
+		"Status Accepted",
+		"Completed Accepted",
+	})
+
+	c.Run("Failure", func(c *qt.C) {
+		srv := newFakeServer(c)
+		srv.statuses = []string{"Invalid"}
+		n := srv.newNotarizer(c, newTestOptions())
+
+		events, errc := n.SubmitWithProgress(context.Background(), "testdata/helloworld.zip")
+		var last Event
+		for e := range events {
+			last = e
+		}
+		c.Assert(last, qt.DeepEquals, Event{Type: EventStatus, SubmissionID: "submission-1", Status: "Invalid"})
+		var statusErr *StatusError
+		c.Assert(errors.As(<-errc, &statusErr), qt.IsTrue)
+	})
+}
+
+func TestSubmitWithTestSigner(t *testing.T) {
+	c := qt.New(t)
+
+	key, signFunc := notarytest.NewTestSigner()
+
+	srv := newFakeServer(c)
+	srv.submit = func(w http.ResponseWriter, r *http.Request) {
+		signed := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		srv.handleSubmit(w, r)
+	}
+	opts := newTestOptions()
+	opts.SignFunc = signFunc
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(srv.submissions, qt.HasLen, 1)
+}
+
+func TestMultiNotarizer(t *testing.T) {
+	c := qt.New(t)
+
+	// Submissions keyed by the issuer in the token.
+	var (
+		mu         sync.Mutex
+		byIssuer   = make(map[string][]string)
+		newOptions = func(issuerID string) Options {
+			opts := newTestOptions()
+			opts.IssuerID = issuerID
+			opts.SignFunc = func(token *jwt.Token) (string, error) {
+				return "token-" + token.Claims.(jwt.MapClaims)["iss"].(string), nil
+			}
+			return opts
+		}
+	)
+	srv := newFakeServer(c)
+	srv.submit = func(w http.ResponseWriter, r *http.Request) {
+		issuer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token-")
+		b, err := io.ReadAll(r.Body)
+		c.Check(err, qt.IsNil)
+		var req submissionRequest
+		c.Check(json.Unmarshal(b, &req), qt.IsNil)
+		mu.Lock()
+		byIssuer[issuer] = append(byIssuer[issuer], req.SubmissionName)
+		mu.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		srv.handleSubmit(w, r)
+	}
+
+	m, err := NewMultiNotarizer(map[string]Options{
+		"client-a": newOptions("aaaaaaaa-96fe-1a63-e053-0824d011072a"),
+		"client-b": newOptions("bbbbbbbb-96fe-1a63-e053-0824d011072a"),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Accounts(), qt.DeepEquals, []string{"client-a", "client-b"})
+	for _, account := range m.Accounts() {
+		srv.configure(m.Notarizer(account))
+	}
+
+	c.Assert(m.SubmitFor("client-a", "testdata/helloworld.zip", WithCallName("a.zip")), qt.IsNil)
+	c.Assert(m.SubmitFor("client-b", "testdata/helloworld.zip", WithCallName("b.zip")), qt.IsNil)
+	c.Assert(m.SubmitFor("client-c", "testdata/helloworld.zip"), qt.ErrorMatches, `unknown account "client-c"`)
+
+	c.Assert(byIssuer, qt.DeepEquals, map[string][]string{
+		"aaaaaaaa-96fe-1a63-e053-0824d011072a": {"a.zip"},
+		"bbbbbbbb-96fe-1a63-e053-0824d011072a": {"b.zip"},
+	})
+
+	_, err = NewMultiNotarizer(map[string]Options{"client-a": {IssuerID: "aaaaaaaa-96fe-1a63-e053-0824d011072a"}})
+	c.Assert(err, qt.ErrorMatches, `account "client-a": .*`)
+}
+
+func TestEventChan(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Sequence", func(c *qt.C) {
+		events := make(chan Event, 10)
+		srv := newFakeServer(c)
+		srv.statuses = []string{"In Progress", "Accepted"}
+		opts := newTestOptions()
+		opts.EventChan = events
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		close(events)
+		var got []EventType
+		for e := range events {
+			got = append(got, e.Type)
+		}
+		c.Assert(got, qt.DeepEquals, []EventType{
+			EventSubmissionCreated,
+			EventUploadStarted,
+			EventProcessingStarted,
+			EventStatus,
+			EventStatus,
+			EventCompleted,
+		})
+	})
+
+	c.Run("Slow consumer", func(c *qt.C) {
+		events := make(chan Event)
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.EventChan = events
+		n := srv.newNotarizer(c, opts)
+
+		// Nobody is receiving, the submission must not block.
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		select {
+		case e := <-events:
+			c.Fatalf("unexpected event %v", e)
+		default:
+		}
+	})
+}
+
+func TestVerifySignature(t *testing.T) {
+	c := qt.New(t)
+
+	if runtime.GOOS != "darwin" {
+		c.Assert(VerifySignature("testdata/helloworld"), qt.ErrorMatches, "VerifySignature requires macOS")
+		return
+	}
+
+	c.Assert(VerifySignature("testdata/helloworld"), qt.IsNil)
+	c.Assert(VerifySignature("testdata/helloworld.go"), qt.ErrorMatches, "codesign verification of testdata/helloworld.go failed.*")
+}
+
+func TestLogLinesIncludeSubmission(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "Invalid"}
+	srv.list = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-10*time.Minute).UTC().Format(http.TimeFormat))
+		fmt.Fprint(w, `{"data": []}`)
+	}
+	opts, logs := newTestOptionsWithLog()
+	opts.CheckClockDrift = true
+	n := srv.newNotarizer(c, opts)
+	var sessions int
+	n.newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+		sessions++
+		if sessions == 1 {
+			return nil, errors.New("transient")
+		}
+		return session.NewSession(cfgs...)
+	}
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.ErrorMatches, `unexpected status: Invalid for submission submission-1 \(log: https://example.org/logs/submission-1\)`)
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	c.Assert(len(lines) > 6, qt.IsTrue)
+	c.Assert(lines[0], qt.Matches, `\[helloworld.zip\] Warning: local clock differs .*`)
+	c.Assert(lines[1], qt.Matches, `\[helloworld.zip\] Submitting with checksum \w+`)
+	for _, line := range lines[2:] {
+		c.Assert(line, qt.Matches, `\[helloworld.zip submission-1\] .*`)
+	}
+	c.Assert(logs.String(), qt.Contains, "[helloworld.zip submission-1] Warning: failed to create AWS session (attempt 1 of 3): transient")
+}
+
+func TestExtraClaims(t *testing.T) {
+	c := qt.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+
+	var signed string
+	opts := newTestOptions()
+	opts.ExtraClaims = map[string]any{"bid": "com.example.helloworld"}
+	opts.SignFunc = func(token *jwt.Token) (string, error) {
+		var err error
+		signed, err = token.SignedString(key)
+		return signed, err
+	}
+	_, err = New(opts)
+	c.Assert(err, qt.IsNil)
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(signed, claims, func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil })
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["bid"], qt.Equals, "com.example.helloworld")
+	c.Assert(claims["iss"], qt.Equals, opts.IssuerID)
+
+	opts.ExtraClaims = map[string]any{"exp": 1528407600}
+	_, err = New(opts)
+	c.Assert(err, qt.ErrorMatches, `ExtraClaims: the "exp" claim can not be overridden`)
+
+	opts.ExtraClaims = map[string]any{"scope": []string{"/other"}}
+	_, err = New(opts)
+	c.Assert(err, qt.ErrorMatches, `ExtraClaims: the "scope" claim can not be overridden`)
+}
+
+func TestAudience(t *testing.T) {
+	c := qt.New(t)
+
+	opts, logs := newTestOptionsWithLog()
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	claims, err := n.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["aud"], qt.Equals, AudienceAppStoreConnectV1)
+	c.Assert(logs.String(), qt.Equals, "")
+
+	opts.Audience = "appstoreconnect-v2"
+	n, err = New(opts)
+	c.Assert(err, qt.IsNil)
+	claims, err = n.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["aud"], qt.Equals, "appstoreconnect-v2")
+	c.Assert(logs.String(), qt.Contains, `Warning: unknown JWT audience "appstoreconnect-v2"`)
+}
+
+func TestFullJitter(t *testing.T) {
+	c := qt.New(t)
+
+	base, max := 5*time.Second, 2*time.Minute
+	p := NewFullJitter(base, max, mathrand.NewSource(32))
+
+	for attempt := 1; attempt <= 20; attempt++ {
+		upper := base << attempt
+		if attempt > 10 || upper > max {
+			upper = max
+		}
+		for i := 0; i < 100; i++ {
+			d := p.Delay(attempt)
+			c.Assert(d >= base && d <= upper, qt.IsTrue, qt.Commentf("attempt %d: %s not in [%s, %s]", attempt, d, base, upper))
+		}
+	}
+
+	// Same seed, same delays.
+	p1, p2 := NewFullJitter(base, max, mathrand.NewSource(32)), NewFullJitter(base, max, mathrand.NewSource(32))
+	for attempt := 1; attempt <= 5; attempt++ {
+		c.Assert(p1.Delay(attempt), qt.Equals, p2.Delay(attempt))
+	}
+}
+
+func TestPollIntervalClamping(t *testing.T) {
+	c := qt.New(t)
+
+	opts := newTestOptions()
+	opts.PollStrategy = PollStrategyFunc(func(attempt int) time.Duration {
+		return time.Duration(attempt) * time.Second
+	})
+
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n.pollDelay(1), qt.Equals, time.Second)
+	c.Assert(n.pollDelay(100), qt.Equals, 100*time.Second)
+
+	opts.MinPollInterval = 5 * time.Second
+	opts.MaxPollInterval = 30 * time.Second
+	n, err = New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(n.pollDelay(1), qt.Equals, 5*time.Second)
+	c.Assert(n.pollDelay(10), qt.Equals, 10*time.Second)
+	c.Assert(n.pollDelay(100), qt.Equals, 30*time.Second)
+
+	// The default strategy is not affected by the defaults.
+	n, err = New(newTestOptions())
+	c.Assert(err, qt.IsNil)
+	c.Assert(n.pollDelay(1), qt.Equals, 11*time.Second)
+}
+
+func TestTokenRefresh(t *testing.T) {
+	c := qt.New(t)
+
+	var signed int
+	opts := newTestOptions()
+	opts.SignFunc = func(token *jwt.Token) (string, error) {
+		signed++
+		return fmt.Sprintf("signed-token-%d", signed), nil
+	}
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+
+	for i := 0; i < 3; i++ {
+		r, err := n.newAPIRequest(context.Background(), "GET", n.baseURL, nil)
+		c.Assert(err, qt.IsNil)
+		c.Assert(r.Header.Get("Authorization"), qt.Equals, "Bearer signed-token-1")
+	}
+
+	// Simulate that the token is about to expire.
+	n.tokenExpires = time.Now().Add(tokenRefreshMargin / 2)
+	r, err := n.newAPIRequest(context.Background(), "GET", n.baseURL, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Header.Get("Authorization"), qt.Equals, "Bearer signed-token-2")
+	c.Assert(signed, qt.Equals, 2)
+}
+
+func TestTokenCache(t *testing.T) {
+	c := qt.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+
+	var signed int
+	opts := newTestOptions()
+	opts.TokenCache = NewMemoryTokenCache()
+	opts.SignFunc = func(token *jwt.Token) (string, error) {
+		signed++
+		return token.SignedString(key)
+	}
+
+	n1, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	n2, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signed, qt.Equals, 1)
+	c.Assert(n2.signature, qt.Equals, n1.signature)
+
+	claims, err := n2.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["iss"], qt.Equals, opts.IssuerID)
+
+	// The claims of a cached token have the same types as those of a new token.
+	claims1, err := n1.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims, qt.DeepEquals, claims1)
+	c.Assert(claims["exp"], qt.Equals, n1.TokenExpiry().Unix())
+	c.Assert(claims["scope"], qt.DeepEquals, []string{"/notary/v2"})
+
+	// Other extra claims do not share the token.
+	opts.ExtraClaims = map[string]any{"bid": "com.example.a", "x": 1}
+	n3, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signed, qt.Equals, 2)
+	opts.ExtraClaims = map[string]any{"bid": "com.example.b", "x": 1}
+	n4, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signed, qt.Equals, 3)
+	claims, err = n4.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims["bid"], qt.Equals, "com.example.b")
+
+	// The same extra claims share the token, regardless of map order.
+	opts.ExtraClaims = map[string]any{"x": 1, "bid": "com.example.a"}
+	n5, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signed, qt.Equals, 3)
+	c.Assert(n5.signature, qt.Equals, n3.signature)
+	claims3, err := n3.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	claims5, err := n5.TokenClaims()
+	c.Assert(err, qt.IsNil)
+	c.Assert(claims5, qt.DeepEquals, claims3)
+
+	// Another key ID does not share the token.
+	opts.ExtraClaims = nil
+	opts.Kid = "DEF456"
+	_, err = New(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signed, qt.Equals, 4)
+}
+
+func BenchmarkCreateAndSignToken(b *testing.B) {
+	n := newBenchmarkNotarizer(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := n.createAndSignToken(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewAPIRequest(b *testing.B) {
+	n := newBenchmarkNotarizer(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := n.newAPIRequest(context.Background(), "GET", n.baseURL, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewUploader(b *testing.B) {
+	n := newBenchmarkNotarizer(b)
+	attrs := submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE", AwsSecretAccessKey: "secret"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := n.newUploader(context.Background(), n.infof, attrs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func newBenchmarkNotarizer(b *testing.B) *Notarizer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	opts := newTestOptions()
+	opts.SignFunc = func(token *jwt.Token) (string, error) {
+		return token.SignedString(key)
+	}
+	n, err := New(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return n
+}
+
+func TestUploadErrorOnCancel(t *testing.T) {
+	c := qt.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newFakeServer(c)
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	err := n.SubmitContext(ctx, "testdata/helloworld.zip")
+	var uploadErr *UploadError
+	c.Assert(errors.As(err, &uploadErr), qt.IsTrue)
+	c.Assert(uploadErr.SubmissionID, qt.Equals, "submission-1")
+	c.Assert(uploadErr.Bucket, qt.Equals, "notary-submissions")
+	c.Assert(uploadErr.Object, qt.Equals, "prod/submission-1")
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue)
+	c.Assert(srv.polls, qt.Equals, 0)
+}
+
+func TestMaxArtifactSize(t *testing.T) {
+	c := qt.New(t)
+
+	// A sparse file, nothing is read before the size check.
+	filename := filepath.Join(c.TempDir(), "large.zip")
+	f, err := os.Create(filename)
+	c.Assert(err, qt.IsNil)
+	c.Assert(f.Truncate(10<<20), qt.IsNil)
+	c.Assert(f.Close(), qt.IsNil)
+
+	srv := newFakeServer(c)
+	opts, buf := newTestOptionsWithLog()
+	opts.MaxArtifactSize = 1 << 20
+	n := srv.newNotarizer(c, opts)
+
+	err = n.Submit(filename)
+	c.Assert(errors.Is(err, ErrArtifactTooLarge), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "large.zip is 10485760 bytes, the limit is 1048576: artifact too large")
+	c.Assert(buf.String(), qt.Contains, "[large.zip] Size 10.0 MiB exceeds MaxArtifactSize 1.0 MiB")
+	c.Assert(srv.submissions, qt.HasLen, 0)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+
+	c.Run("SubmitURL", func(c *qt.C) {
+		for _, contentLength := range []int64{10 << 20, -1} {
+			var read countingReader
+			read.r = io.LimitReader(zeroReader{}, 10<<20)
+			opts := newTestOptions()
+			opts.MaxArtifactSize = 1 << 20
+			opts.HTTPClient = &http.Client{
+				Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					return &http.Response{StatusCode: http.StatusOK, Status: "200 OK", ContentLength: contentLength, Body: io.NopCloser(&read), Request: r}, nil
+				}),
+			}
+			opts.S3HTTPClient = &http.Client{}
+			n := srv.newNotarizer(c, opts)
+
+			err := n.SubmitURL(context.Background(), "https://example.org/large.zip", "large.zip")
+			c.Assert(errors.Is(err, ErrArtifactTooLarge), qt.IsTrue, qt.Commentf("%v", err))
+			if contentLength > 0 {
+				c.Assert(read.n, qt.Equals, int64(0))
+			} else {
+				c.Assert(read.n, qt.Equals, int64(1<<20+1))
+			}
+		}
+		c.Assert(srv.submissions, qt.HasLen, 1)
+	})
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func TestRefreshCredsOnUploadAuthError(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func(c *qt.C) *fakeServer {
+		srv := newFakeServer(c)
+		srv.upload = func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/submission-1") {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+				return
+			}
+			srv.handleUpload(w, r)
+		}
+		return srv
+	}
+
+	c.Run("Refresh", func(c *qt.C) {
+		srv := newServer(c)
+		var created []string
+		opts := newTestOptions()
+		opts.RefreshCredsOnUploadAuthError = true
+		opts.OnSubmissionCreated = func(id string) {
+			created = append(created, id)
+		}
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(created, qt.DeepEquals, []string{"submission-1", "submission-2"})
+		c.Assert(srv.uploads()["/notary-submissions/prod/submission-2"], qt.Not(qt.IsNil))
+	})
+
+	c.Run("Disabled", func(c *qt.C) {
+		srv := newServer(c)
+		n := srv.newNotarizer(c, newTestOptions())
+
+		err := n.Submit("testdata/helloworld.zip")
+		c.Assert(err, qt.ErrorMatches, "(?s)upload of submission submission-1 to s3://notary-submissions/prod/submission-1 failed: AccessDenied: Access Denied.*")
+		c.Assert(srv.submissions, qt.HasLen, 1)
+	})
+
+	c.Run("Bounded", func(c *qt.C) {
+		srv := newFakeServer(c)
+		srv.upload = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>`)
+		}
+		opts := newTestOptions()
+		opts.RefreshCredsOnUploadAuthError = true
+		opts.MaxCredentialRefreshes = 2
+		n := srv.newNotarizer(c, opts)
+
+		err := n.Submit("testdata/helloworld.zip")
+		c.Assert(err, qt.ErrorMatches, "(?s)upload of submission submission-3 to .* failed: NoSuchBucket: .*")
+		c.Assert(srv.submissions, qt.HasLen, 3)
+	})
+}
+
+func TestSubmissionResponseMissingField(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.submit = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data": {"type": "newSubmissions", "id": "submission-1", "attributes": {"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "awsSessionToken": "session", "s3Bucket": "notary-submissions", "object": "prod/submission-1"}}}`)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.ErrorMatches, `the response from Apple is missing "bucket"`)
+	c.Assert(srv.uploads(), qt.HasLen, 0)
+}
+
+func TestRefreshCredsUsesCallerContext(t *testing.T) {
+	c := qt.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := newFakeServer(c)
+	srv.upload = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`)
+	}
+	opts := newTestOptions()
+	opts.RefreshCredsOnUploadAuthError = true
+	var posts int
+	opts.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if r.Method == "POST" {
+				posts++
+				if posts == 2 {
+					// Cancel while refreshing the credentials.
+					cancel()
+					if err := r.Context().Err(); err != nil {
+						return nil, err
+					}
+				}
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		}),
+	}
+	opts.S3HTTPClient = &http.Client{}
+	n := srv.newNotarizer(c, opts)
+
+	start := time.Now()
+	err := n.SubmitContext(ctx, "testdata/helloworld.zip")
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("%v", err))
+	c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue)
+	c.Assert(posts, qt.Equals, 2)
+	c.Assert(srv.submissions, qt.HasLen, 1)
+}
+
+func TestBuildUploadInput(t *testing.T) {
+	c := qt.New(t)
+
+	var resp submissionResponse
+	c.Assert(json.Unmarshal([]byte(`{"data": {"id": "abc", "attributes": {"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "awsSessionToken": "session", "bucket": "notary-submissions", "object": "prod/abc"}}}`), &resp), qt.IsNil)
+
+	body := strings.NewReader("data")
+	input := buildUploadInput(resp.Data.Attributes, body, ContentTypeFor(FormatZip))
+	c.Assert(*input.Bucket, qt.Equals, "notary-submissions")
+	c.Assert(*input.Key, qt.Equals, "prod/abc")
+	c.Assert(*input.ContentType, qt.Equals, "application/zip")
+	c.Assert(input.Body, qt.Equals, io.Reader(body))
+}
+
+func TestUploadServerSideEncryption(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name   string
+		sse    string
+		keyID  string
+		header http.Header
+	}{
+		{"Unset", "", "", http.Header{}},
+		{"KMS", "aws:kms", "key-1", http.Header{"X-Amz-Server-Side-Encryption": {"aws:kms"}, "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": {"key-1"}}},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			srv := newFakeServer(c)
+			header := make(http.Header)
+			srv.upload = func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range r.Header {
+					if strings.HasPrefix(k, "X-Amz-Server-Side-Encryption") {
+						header[k] = v
+					}
+				}
+				srv.handleUpload(w, r)
+			}
+			opts := newTestOptions()
+			opts.ServerSideEncryption = test.sse
+			opts.SSEKMSKeyID = test.keyID
+			n := srv.newNotarizer(c, opts)
+
+			c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+			c.Assert(header, qt.DeepEquals, test.header)
+		})
+	}
+}
+
+func TestNewSessionRetry(t *testing.T) {
+	c := qt.New(t)
+
+	c.Run("Fail once", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts, buf := newTestOptionsWithLog()
+		n := srv.newNotarizer(c, opts)
+		var calls int
+		n.newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("transient")
+			}
+			return session.NewSession(cfgs...)
+		}
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(calls, qt.Equals, 2)
+		c.Assert(buf.String(), qt.Contains, "Warning: failed to create AWS session (attempt 1 of 3): transient")
+
+		// The session is reused.
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(calls, qt.Equals, 2)
+	})
+
+	c.Run("Fail always", func(c *qt.C) {
+		srv := newFakeServer(c)
+		n := srv.newNotarizer(c, newTestOptions())
+		var calls int
+		n.newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+			calls++
+			return nil, errors.New("permanent")
+		}
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.ErrorMatches, ".*failed to create AWS session: permanent")
+		c.Assert(calls, qt.Equals, 3)
+	})
+
+	c.Run("Canceled while waiting", func(c *qt.C) {
+		n, err := New(newTestOptions())
+		c.Assert(err, qt.IsNil)
+		var calls int
+		n.newSession = func(cfgs ...*aws.Config) (*session.Session, error) {
+			calls++
+			return nil, errors.New("transient")
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err = n.s3BaseSession(ctx, n.infof)
+		c.Assert(err, qt.Equals, context.Canceled)
+		c.Assert(calls, qt.Equals, 1)
+
+		// The lock is not held while waiting.
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			n.s3BaseSession(ctx, n.infof)
+			close(done)
+		}()
+		time.Sleep(20 * time.Millisecond)
+		n.s3SessionMu.Lock()
+		n.s3SessionMu.Unlock()
+		select {
+		case <-done:
+			c.Fatal("lock held until the retries were done")
+		default:
+		}
+		<-done
+	})
+}
+
+func TestUploaderRegionHint(t *testing.T) {
+	c := qt.New(t)
+
+	n, err := New(newTestOptions())
+	c.Assert(err, qt.IsNil)
+
+	var resp submissionResponse
+	c.Assert(json.Unmarshal([]byte(`{"data": {"id": "abc", "attributes": {"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "bucket": "notary-submissions", "object": "prod/abc", "region": "eu-west-1", "endpoint": "https://s3.example.org"}}}`), &resp), qt.IsNil)
+
+	u, err := n.newUploader(context.Background(), n.infof, resp.Data.Attributes)
+	c.Assert(err, qt.IsNil)
+	client := u.S3.(*s3.S3)
+	c.Assert(*client.Config.Region, qt.Equals, "eu-west-1")
+	c.Assert(client.Endpoint, qt.Equals, "https://s3.example.org")
+
+	u, err = n.newUploader(context.Background(), n.infof, submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE", AwsSecretAccessKey: "secret"})
+	c.Assert(err, qt.IsNil)
+	client = u.S3.(*s3.S3)
+	c.Assert(*client.Config.Region, qt.Equals, "us-west-2")
+	c.Assert(client.Endpoint, qt.Equals, "https://s3.us-west-2.amazonaws.com")
+}
+
+func TestHTTPClients(t *testing.T) {
+	c := qt.New(t)
+
+	// Count the requests through each client's transport.
+	newClient := func(count *int32) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					atomic.AddInt32(count, 1)
+					return nil, nil
+				},
+			},
+		}
+	}
+
+	c.Run("Separate", func(c *qt.C) {
+		var apiCount, s3Count int32
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.HTTPClient = newClient(&apiCount)
+		opts.S3HTTPClient = newClient(&s3Count)
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		// Submit and one status check.
+		c.Assert(atomic.LoadInt32(&apiCount), qt.Equals, int32(2))
+		c.Assert(atomic.LoadInt32(&s3Count), qt.Equals, int32(1))
+	})
+
+	c.Run("Only S3HTTPClient", func(c *qt.C) {
+		var count int32
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.S3HTTPClient = newClient(&count)
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(atomic.LoadInt32(&count), qt.Equals, int32(3))
+	})
+
+	c.Run("Only HTTPClient", func(c *qt.C) {
+		var count int32
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.HTTPClient = newClient(&count)
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(atomic.LoadInt32(&count), qt.Equals, int32(3))
+	})
+}
+
+func TestUploaderSharesHTTPClient(t *testing.T) {
+	c := qt.New(t)
+
+	n, err := New(newTestOptions())
+	c.Assert(err, qt.IsNil)
+
+	u1, err := n.newUploader(context.Background(), n.infof, submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE1", AwsSecretAccessKey: "secret1"})
+	c.Assert(err, qt.IsNil)
+	u2, err := n.newUploader(context.Background(), n.infof, submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE2", AwsSecretAccessKey: "secret2"})
+	c.Assert(err, qt.IsNil)
+
+	cfg1, cfg2 := u1.S3.(*s3.S3).Config, u2.S3.(*s3.S3).Config
+	c.Assert(cfg1.HTTPClient, qt.Not(qt.IsNil))
+	c.Assert(cfg1.HTTPClient == cfg2.HTTPClient, qt.IsTrue)
+	c.Assert(cfg1.HTTPClient == http.DefaultClient, qt.IsFalse)
+
+	creds1, err := cfg1.Credentials.Get()
+	c.Assert(err, qt.IsNil)
+	creds2, err := cfg2.Credentials.Get()
+	c.Assert(err, qt.IsNil)
+	c.Assert(creds1.AccessKeyID, qt.Equals, "AKIAEXAMPLE1")
+	c.Assert(creds2.AccessKeyID, qt.Equals, "AKIAEXAMPLE2")
+}
+
+func TestLeavePartsOnError(t *testing.T) {
+	c := qt.New(t)
+
+	attrs := submissionAttributes{AwsAccessKeyID: "AKIAEXAMPLE", AwsSecretAccessKey: "secret"}
+
+	for _, leave := range []bool{false, true} {
+		opts := newTestOptions()
+		opts.LeavePartsOnError = leave
+		n, err := New(opts)
+		c.Assert(err, qt.IsNil)
+		uploader, err := n.newUploader(context.Background(), n.infof, attrs)
+		c.Assert(err, qt.IsNil)
+		c.Assert(uploader.LeavePartsOnError, qt.Equals, leave)
+	}
+}
+
+func TestSubmitContextDeadline(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress"}
+	opts := newTestOptions()
+	opts.SubmissionTimeout = time.Hour
+	n := srv.newNotarizer(c, opts)
+	n.opts.PollStrategy = PollStrategyFunc(func(int) time.Duration { return 10 * time.Millisecond })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := n.SubmitContext(ctx, "testdata/helloworld.zip")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue, qt.Commentf("%v", err))
+	c.Assert(time.Since(start) < 10*time.Second, qt.IsTrue)
+}
+
+func TestSubmitUnauthorized(t *testing.T) {
+	c := qt.New(t)
+
+	unauthorized := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errors": [{"status": "401", "code": "NOT_AUTHORIZED", "title": "Authentication credentials are missing or invalid."}]}`)
+	}
+
+	c.Run("Submission", func(c *qt.C) {
+		srv := newFakeServer(c)
+		srv.submit = unauthorized
+		n := srv.newNotarizer(c, newTestOptions())
+
+		err := n.Submit("testdata/helloworld.zip")
+		c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue, qt.Commentf("%v", err))
+		c.Assert(err, qt.ErrorMatches, "notary API responded with status 401: NOT_AUTHORIZED: Authentication credentials are missing or invalid.")
+	})
+
+	c.Run("Status", func(c *qt.C) {
+		srv := newFakeServer(c)
+		n := srv.newNotarizer(c, newTestOptions())
+		n.opts.HTTPClient = &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if r.Method == "GET" {
+					rec := httptest.NewRecorder()
+					unauthorized(rec, r)
+					return rec.Result(), nil
+				}
+				return http.DefaultTransport.RoundTrip(r)
+			}),
+		}
+
+		err := n.Submit("testdata/helloworld.zip")
+		c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue, qt.Commentf("%v", err))
+		c.Assert(err, qt.ErrorMatches, "failed to check status for ID submission-1: notary API responded with status 401: NOT_AUTHORIZED: .*")
+	})
+}
+
+func TestAPIErrorWithStatusOK(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.submit = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errors": [{"id": "d1c2e7", "status": "409", "code": "ENTITY_ERROR", "title": "The submission is invalid.", "detail": "The sha256 is not valid."}]}`)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	err := n.Submit("testdata/helloworld.zip")
+	var apiErr *APIError
+	c.Assert(errors.As(err, &apiErr), qt.IsTrue, qt.Commentf("%v", err))
+	c.Assert(apiErr.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(apiErr.Errors, qt.HasLen, 1)
+	c.Assert(apiErr.Errors[0].Code, qt.Equals, "ENTITY_ERROR")
+	c.Assert(err, qt.ErrorMatches, "notary API responded with status 200: ENTITY_ERROR: The submission is invalid.: The sha256 is not valid.")
+	c.Assert(srv.uploads(), qt.HasLen, 0)
+}
+
+func TestSubmitURL(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+
+	artifacts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "ci" || pass != "s3cr3t" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Write(b)
+	}))
+	defer artifacts.Close()
+
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	n := srv.newNotarizer(c, opts)
+
+	err = n.SubmitURL(context.Background(), artifacts.URL+"/helloworld.zip", "helloworld.zip")
+	var downloadErr *DownloadError
+	c.Assert(errors.As(err, &downloadErr), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "failed to download .*/helloworld.zip: 401 Unauthorized")
+	c.Assert(srv.submissions, qt.HasLen, 0)
+
+	request, err := http.NewRequest("GET", artifacts.URL, nil)
+	c.Assert(err, qt.IsNil)
+	request.SetBasicAuth("ci", "s3cr3t")
+	opts.DownloadHeader = request.Header
+	n = srv.newNotarizer(c, opts)
+
+	c.Assert(n.SubmitURL(context.Background(), artifacts.URL+"/helloworld.zip", "helloworld.zip"), qt.IsNil)
+	c.Assert(srv.submissions, qt.HasLen, 1)
+	c.Assert(srv.submissions[0].SubmissionName, qt.Equals, "helloworld.zip")
+	c.Assert(bytes.Equal(srv.uploads()["/notary-submissions/prod/submission-1"], b), qt.IsTrue)
+}
+
+func TestNetworkError(t *testing.T) {
+	c := qt.New(t)
+
+	opts := newTestOptions()
+	opts.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			if err := r.Context().Err(); err != nil {
+				return nil, err
+			}
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connect: connection refused")}
+		}),
+	}
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+
+	err = n.Submit("testdata/helloworld.zip")
+	c.Assert(errors.Is(err, ErrNetwork), qt.IsTrue)
+	var opErr *net.OpError
+	c.Assert(errors.As(err, &opErr), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "failed to reach the Notary API, check the network connection and any proxy settings: .*connection refused")
+
+	// Cancellation is not a network error.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = n.CheckCredentials(ctx)
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue)
+	c.Assert(errors.Is(err, ErrNetwork), qt.IsFalse)
+
+	c.Run("TLS", func(c *qt.C) {
+		srv := httptest.NewTLSServer(http.NotFoundHandler())
+		c.Cleanup(srv.Close)
+		n, err := New(newTestOptions())
+		c.Assert(err, qt.IsNil)
+		n.baseURL = srv.URL
+
+		// The server's certificate is not trusted.
+		err = n.CheckCredentials(context.Background())
+		c.Assert(err, qt.ErrorMatches, ".*certificate.*")
+		c.Assert(errors.Is(err, ErrNetwork), qt.IsFalse)
+	})
+
+	c.Run("Timeout", func(c *qt.C) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		c.Cleanup(srv.Close)
+		opts := newTestOptions()
+		opts.HTTPClient = &http.Client{Timeout: 50 * time.Millisecond}
+		n, err := New(opts)
+		c.Assert(err, qt.IsNil)
+		n.baseURL = srv.URL
+
+		c.Assert(errors.Is(n.CheckCredentials(context.Background()), ErrNetwork), qt.IsTrue)
+	})
+
+	c.Run("Other", func(c *qt.C) {
+		opts := newTestOptions()
+		opts.HTTPClient = &http.Client{
+			Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("custom transport error")
+			}),
+		}
+		n, err := New(opts)
+		c.Assert(err, qt.IsNil)
+
+		err = n.CheckCredentials(context.Background())
+		c.Assert(err, qt.ErrorMatches, ".*custom transport error")
+		c.Assert(errors.Is(err, ErrNetwork), qt.IsFalse)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestLastRateLimit(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.list = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit", "user-hour-lim:3500;user-hour-rem:3499;")
+		fmt.Fprint(w, `{"data": []}`)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	c.Assert(n.LastRateLimit().IsZero(), qt.IsTrue)
+	c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+	c.Assert(n.LastRateLimit(), qt.Equals, RateLimitInfo{Limit: 3500, Remaining: 3499})
+
+	c.Assert(parseRateLimit(""), qt.Equals, RateLimitInfo{})
+	c.Assert(parseRateLimit("user-hour-rem:12; user-hour-lim:3600"), qt.Equals, RateLimitInfo{Limit: 3600, Remaining: 12})
+	c.Assert(parseRateLimit("user-hour-lim:abc;foo:1;bar"), qt.Equals, RateLimitInfo{})
+}
+
+func TestWarm(t *testing.T) {
+	c := qt.New(t)
+
+	var dials int32
+	dialer := &net.Dialer{}
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.HTTPClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	opts.S3HTTPClient = &http.Client{}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Warm(context.Background()), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&dials), qt.Equals, int32(1))
+	c.Assert(n.TokenValidFor() > 0, qt.IsTrue)
+	n.s3SessionMu.Lock()
+	c.Assert(n.s3Session, qt.Not(qt.IsNil))
+	n.s3SessionMu.Unlock()
+
+	// The submission reuses the connection.
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(atomic.LoadInt32(&dials), qt.Equals, int32(1))
+}
+
+func TestCheckCredentials(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	n := srv.newNotarizer(c, newTestOptions())
+	c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+
+	srv.list = func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errors": [{"status": "401", "code": "NOT_AUTHORIZED", "title": "Authentication credentials are missing or invalid.", "detail": "Provide a properly configured and signed bearer token, and make sure that it has not expired."}]}`)
+	}
+	err := n.CheckCredentials(context.Background())
+	c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "notary API responded with status 401: NOT_AUTHORIZED: Authentication credentials are missing or invalid.*")
+}
+
+func TestSubmitContextCancelDuringPollDelay(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	n := srv.newNotarizer(c, newTestOptions())
+	goroutines := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n.opts.PollStrategy = PollStrategyFunc(func(int) time.Duration {
+		time.AfterFunc(50*time.Millisecond, cancel)
+		return time.Hour
+	})
+
+	start := time.Now()
+	err := n.SubmitContext(ctx, "testdata/helloworld.zip")
+	c.Assert(errors.Is(err, context.Canceled), qt.IsTrue, qt.Commentf("%v", err))
+	c.Assert(time.Since(start) < 10*time.Second, qt.IsTrue)
+	c.Assert(srv.polls, qt.Equals, 0)
+
+	// Nothing is left running, apart from the idle HTTP connections closed here.
+	srv.CloseClientConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(runtime.NumGoroutine() <= goroutines, qt.IsTrue, qt.Commentf("%d goroutines, started with %d", runtime.NumGoroutine(), goroutines))
+}
+
+func TestLastResponse(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.list = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "NX4FVKPHJW4QXYLNIUFS4HHVMA")
+		fmt.Fprint(w, `{"data": [], "meta": {}}`)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+	c.Assert(n.LastResponse(), qt.DeepEquals, ResponseInfo{})
+
+	c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+	last := n.LastResponse()
+	c.Assert(last.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(last.Header.Get("X-Request-Id"), qt.Equals, "NX4FVKPHJW4QXYLNIUFS4HHVMA")
+}
+
+func TestListSubmissions(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.list = func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/submissions.json")
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	ids := func(submissions []Submission) []string {
+		var ids []string
+		for _, s := range submissions {
+			ids = append(ids, s.ID)
+		}
+		return ids
+	}
+
+	list := func(opts ListOptions) []string {
+		submissions, err := n.ListSubmissions(context.Background(), opts)
+		c.Assert(err, qt.IsNil)
+		return ids(submissions)
+	}
+
+	all, err := n.ListSubmissions(context.Background(), ListOptions{})
+	c.Assert(err, qt.IsNil)
+	c.Assert(all, qt.HasLen, 4)
+	c.Assert(all[0], qt.DeepEquals, Submission{
+		ID:          "2efe2717-52ef-43a5-96dc-0797e4ca1041",
+		Name:        "helloworld.zip",
+		Status:      "Accepted",
+		CreatedDate: time.Date(2022, 8, 30, 11, 13, 48, 0, time.UTC),
+	})
+
+	since := time.Date(2022, 8, 29, 0, 0, 0, 0, time.UTC)
+	c.Assert(list(ListOptions{Status: "Invalid"}), qt.DeepEquals, []string{"9a1ac6a8-9f3e-4b39-9f6b-1a4f7ec4a3b1", "cf0c235a-4ce1-4b1c-9ec1-3b4f35e2a7d9"})
+	c.Assert(list(ListOptions{Since: since}), qt.DeepEquals, []string{"2efe2717-52ef-43a5-96dc-0797e4ca1041", "9a1ac6a8-9f3e-4b39-9f6b-1a4f7ec4a3b1"})
+	c.Assert(list(ListOptions{Status: "Invalid", Since: since}), qt.DeepEquals, []string{"9a1ac6a8-9f3e-4b39-9f6b-1a4f7ec4a3b1"})
+	c.Assert(list(ListOptions{Limit: 3}), qt.HasLen, 3)
+}
+
+func TestOnLogAvailable(t *testing.T) {
+	c := qt.New(t)
+
+	for _, status := range []string{"Accepted", "Invalid"} {
+		c.Run(status, func(c *qt.C) {
+			srv := newFakeServer(c)
+			srv.statuses = []string{status}
+			var logs []string
+			opts := newTestOptions()
+			opts.OnLogAvailable = func(submissionID, logURL string) {
+				logs = append(logs, submissionID+" "+logURL)
+			}
+			n := srv.newNotarizer(c, opts)
+
+			err := n.Submit("testdata/helloworld.zip")
+			if status == "Accepted" {
+				c.Assert(err, qt.IsNil)
+			} else {
+				c.Assert(err, qt.Not(qt.IsNil))
+			}
+			c.Assert(logs, qt.DeepEquals, []string{"submission-1 https://example.org/logs/submission-1"})
+
+			// Fetching the log URL again does not call the hook.
+			_, err = n.LogURL(context.Background(), "submission-1")
+			c.Assert(err, qt.IsNil)
+			c.Assert(logs, qt.HasLen, 1)
+		})
+	}
+}
+
+func TestVerboseSubmitLogLine(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	opts, logs := newTestOptionsWithLog()
+	opts.Verbose = true
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(logs.String(), qt.Contains, "[helloworld.zip] Submitting 680.4 KiB (a53c8738) with checksum a53c8738fdd28a3558057c8825f633860846773baae89cf3e0e36f12896393af\n")
+
+	c.Assert(formatSize(512), qt.Equals, "512 B")
+	c.Assert(formatSize(3*1024*1024), qt.Equals, "3.0 MiB")
+}
+
+func TestStatusErrorWhenLogsUnavailable(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"Invalid"}
+	srv.logs = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}
+	n := srv.newNotarizer(c, newTestOptions())
+
+	err := n.Submit("testdata/helloworld.zip")
+	var statusErr *StatusError
+	c.Assert(errors.As(err, &statusErr), qt.IsTrue)
+	c.Assert(statusErr.ID, qt.Equals, "submission-1")
+	c.Assert(statusErr.Status, qt.Equals, "Invalid")
+	c.Assert(statusErr.LogURL, qt.Equals, "")
+	c.Assert(errors.Unwrap(err), qt.ErrorMatches, "failed to fetch logs with ID submission-1: notary API responded with status 500")
+	c.Assert(err, qt.ErrorMatches, `unexpected status: Invalid for submission submission-1 \(failed to fetch logs: .*status 500\)`)
+}
+
+func TestSkipLogFetchOnFailure(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"Invalid"}
+	var logFetches int
+	srv.logs = func(w http.ResponseWriter, r *http.Request) {
+		logFetches++
+		fmt.Fprint(w, `{"data": {"id": "submission-1", "type": "submissionsLog", "attributes": {"developerLogUrl": "https://example.org/logs/submission-1"}}}`)
+	}
+	opts := newTestOptions()
+	opts.SkipLogFetchOnFailure = true
+	n := srv.newNotarizer(c, opts)
+
+	err := n.Submit("testdata/helloworld.zip")
+	c.Assert(err, qt.ErrorMatches, "unexpected status: Invalid for submission submission-1")
+	var statusErr *StatusError
+	c.Assert(errors.As(err, &statusErr), qt.IsTrue)
+	c.Assert(statusErr.LogURL, qt.Equals, "")
+	c.Assert(logFetches, qt.Equals, 0)
+
+	logURL, err := n.LogURL(context.Background(), statusErr.ID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logURL, qt.Equals, "https://example.org/logs/submission-1")
+	c.Assert(logFetches, qt.Equals, 1)
+}
+
+func TestNoOutputWithDefaultLogger(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	c.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "Invalid"}
+	srv.logs = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}
+	opts := newTestOptions()
+	opts.InfoLoggerf = nil
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.Not(qt.IsNil))
+	c.Assert(buf.String(), qt.Equals, "")
+}
+
+func TestSubmissionStore(t *testing.T) {
+	c := qt.New(t)
+
+	storeFile := filepath.Join(c.TempDir(), "submissions.json")
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress"}
+
+	// The first run times out waiting for Apple.
+	opts := newTestOptions()
+	opts.SubmissionStore = NewFileSubmissionStore(storeFile)
+	opts.SubmissionTimeout = 50 * time.Millisecond
+	n := srv.newNotarizer(c, opts)
+	n.opts.PollStrategy = PollStrategyFunc(func(int) time.Duration { return 10 * time.Millisecond })
+	err := n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-42"))
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+
+	// The second run, in a new process, resumes the submission.
+	srv.mu.Lock()
+	srv.statuses = []string{"Accepted"}
+	srv.mu.Unlock()
+	opts, buf := newTestOptionsWithLog()
+	opts.SubmissionStore = NewFileSubmissionStore(storeFile)
+	n = srv.newNotarizer(c, opts)
+	c.Assert(n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-42")), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, `[helloworld.zip submission-1] Resuming submission stored for key "build-42"`)
+	c.Assert(srv.submissions, qt.HasLen, 1)
+	c.Assert(srv.uploads(), qt.HasLen, 1)
+
+	// A new key submits again.
+	c.Assert(n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-43")), qt.IsNil)
+	c.Assert(srv.submissions, qt.HasLen, 2)
+
+	id, found, err := NewFileSubmissionStore(storeFile).Get("build-43")
+	c.Assert(err, qt.IsNil)
+	c.Assert(found, qt.IsTrue)
+	c.Assert(id, qt.Equals, "submission-2")
+
+	c.Run("Not found", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts, buf := newTestOptionsWithLog()
+		opts.SubmissionStore = NewMemorySubmissionStore()
+		c.Assert(opts.SubmissionStore.Put("build-42", "unknown-id"), qt.IsNil)
+		n := srv.newNotarizer(c, opts)
+
+		_, err := n.checkStatus(context.Background(), n.infof, 1, "unknown-id")
+		c.Assert(errors.Is(err, ErrSubmissionNotFound), qt.IsTrue)
+		var notFoundErr *SubmissionNotFoundError
+		c.Assert(errors.As(err, &notFoundErr), qt.IsTrue)
+		c.Assert(notFoundErr.ID, qt.Equals, "unknown-id")
+		c.Assert(err, qt.ErrorMatches, "submission unknown-id not found")
+
+		// The stale ID is replaced by a new submission.
+		c.Assert(n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-42")), qt.IsNil)
+		c.Assert(buf.String(), qt.Contains, "[helloworld.zip unknown-id] Stored submission not found, submitting again")
+		c.Assert(srv.submissions, qt.HasLen, 1)
+		id, found, err := opts.SubmissionStore.Get("build-42")
+		c.Assert(err, qt.IsNil)
+		c.Assert(found, qt.IsTrue)
+		c.Assert(id, qt.Equals, "submission-1")
+	})
+
+	c.Run("Invalid", func(c *qt.C) {
+		storeFile := filepath.Join(c.TempDir(), "submissions.json")
+		srv := newFakeServer(c)
+		srv.statuses = []string{"Invalid"}
+		opts := newTestOptions()
+		opts.SubmissionStore = NewFileSubmissionStore(storeFile)
+		n := srv.newNotarizer(c, opts)
+
+		var statusErr *StatusError
+		c.Assert(errors.As(n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-42")), &statusErr), qt.IsTrue)
+		_, found, err := opts.SubmissionStore.Get("build-42")
+		c.Assert(err, qt.IsNil)
+		c.Assert(found, qt.IsFalse)
+
+		// The next run submits again.
+		srv.mu.Lock()
+		srv.statuses = []string{"Accepted"}
+		srv.mu.Unlock()
+		c.Assert(n.Submit("testdata/helloworld.zip", WithCallSubmissionKey("build-42")), qt.IsNil)
+		c.Assert(srv.submissions, qt.HasLen, 2)
+	})
+
+	c.Run("Memory", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts := newTestOptions()
+		opts.SubmissionStore = NewMemorySubmissionStore()
+		n := srv.newNotarizer(c, opts)
+
+		// Keyed by checksum by default.
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(srv.submissions, qt.HasLen, 1)
+		c.Assert(srv.polls, qt.Equals, 2)
+	})
+}
+
+func TestManifestPollCount(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress", "In Progress", "In Progress", "Accepted"}
+	var manifest Manifest
+	opts := newTestOptions()
+	opts.PostAcceptHook = func(m Manifest) error {
+		manifest = m
+		return nil
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(manifest.PollCount, qt.Equals, 4)
+	c.Assert(manifest.PollCount, qt.Equals, srv.polls)
+}
+
+func TestPostAcceptHook(t *testing.T) {
+	c := qt.New(t)
+
+	var accepted []Manifest
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.PostAcceptHook = func(m Manifest) error {
+		accepted = append(accepted, m)
+		if m.SubmissionID == "submission-2" {
+			return errors.New("spctl: rejected")
+		}
+		return nil
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(accepted, qt.HasLen, 1)
+	c.Assert(accepted[0].Status, qt.Equals, "Accepted")
+	c.Assert(accepted[0].Path, qt.Equals, "testdata/helloworld.zip")
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.ErrorMatches, "post accept hook for submission submission-2: spctl: rejected")
+
+	srv.statuses = []string{"Invalid"}
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.Not(qt.IsNil))
+	c.Assert(accepted, qt.HasLen, 2)
+}
+
+func TestManifestDir(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.ManifestDir = filepath.Join(c.TempDir(), "manifests")
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+
+	b, err := os.ReadFile(filepath.Join(opts.ManifestDir, "submission-1.json"))
+	c.Assert(err, qt.IsNil)
+	var m Manifest
+	c.Assert(json.Unmarshal(b, &m), qt.IsNil)
+	c.Assert(m, qt.DeepEquals, Manifest{
+		Path:           "testdata/helloworld.zip",
+		SubmissionName: "helloworld.zip",
+		Sha256:         "a53c8738fdd28a3558057c8825f633860846773baae89cf3e0e36f12896393af",
+		SubmissionID:   "submission-1",
+		S3Location:     srv.URL + "/notary-submissions/prod/submission-1",
+		Status:         "Accepted",
+		PollCount:      1,
+	})
+	c.Assert(string(b), qt.Not(qt.Contains), "secret")
+
+	c.Run("Write failure", func(c *qt.C) {
+		srv := newFakeServer(c)
+		opts, logs := newTestOptionsWithLog()
+		// A file where the directory should be.
+		opts.ManifestDir = filepath.Join(c.TempDir(), "file")
+		c.Assert(os.WriteFile(opts.ManifestDir, nil, 0o644), qt.IsNil)
+		var accepted bool
+		opts.PostAcceptHook = func(m Manifest) error {
+			accepted = true
+			return nil
+		}
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(accepted, qt.IsTrue)
+		c.Assert(logs.String(), qt.Contains, "[helloworld.zip submission-1] Warning: failed to write manifest: ")
+	})
+}
+
+func TestSubmitOptions(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	srv.statuses = []string{"In Progress"}
+	opts := newTestOptions()
+	opts.SubmissionTimeout = time.Hour
+	n := srv.newNotarizer(c, opts)
+	n.opts.PollStrategy = PollStrategyFunc(func(int) time.Duration { return 10 * time.Millisecond })
+
+	var (
+		wg       sync.WaitGroup
+		elapsed  [2]time.Duration
+		timeouts = [2]time.Duration{100 * time.Millisecond, 2 * time.Second}
+	)
+	for i := range timeouts {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := n.Submit("testdata/helloworld.zip", WithCallSubmissionTimeout(timeouts[i]), WithCallName(fmt.Sprintf("call%d.zip", i)))
+			c.Check(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+			elapsed[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(elapsed[0] < timeouts[1], qt.IsTrue, qt.Commentf("%s", elapsed[0]))
+	c.Assert(elapsed[1] >= timeouts[1], qt.IsTrue, qt.Commentf("%s", elapsed[1]))
+	c.Assert(n.opts.SubmissionTimeout, qt.Equals, time.Hour)
+
+	var names []string
+	for _, s := range srv.submissions {
+		names = append(names, s.SubmissionName)
+	}
+	sort.Strings(names)
+	c.Assert(names, qt.DeepEquals, []string{"call0.zip", "call1.zip"})
+}
+
+func TestCheckClockDrift(t *testing.T) {
+	c := qt.New(t)
+
+	newServer := func(drift time.Duration) *fakeServer {
+		srv := newFakeServer(c)
+		srv.list = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(drift).UTC().Format(http.TimeFormat))
+			fmt.Fprint(w, `{"data": []}`)
+		}
+		return srv
+	}
+
+	c.Run("Warn", func(c *qt.C) {
+		srv := newServer(-10 * time.Minute)
+		opts, buf := newTestOptionsWithLog()
+		opts.CheckClockDrift = true
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+		c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+		c.Assert(strings.Count(buf.String(), "Warning: local clock differs"), qt.Equals, 1)
+		c.Assert(buf.String(), qt.Matches, `(?s).*by 10m[01]s.*`)
+	})
+
+	c.Run("Strict", func(c *qt.C) {
+		srv := newServer(10 * time.Minute)
+		opts := newTestOptions()
+		opts.CheckClockDrift = true
+		opts.StrictClockDrift = true
+		n := srv.newNotarizer(c, opts)
+
+		err := n.CheckCredentials(context.Background())
+		c.Assert(errors.Is(err, ErrClockDrift), qt.IsTrue)
+	})
+
+	c.Run("Strict before submit", func(c *qt.C) {
+		drift := 10 * time.Minute
+		srv := newFakeServer(c)
+		srv.list = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().Add(drift).UTC().Format(http.TimeFormat))
+			fmt.Fprint(w, `{"data": []}`)
+		}
+		opts := newTestOptions()
+		opts.CheckClockDrift = true
+		opts.StrictClockDrift = true
+		n := srv.newNotarizer(c, opts)
+
+		err := n.Submit("testdata/helloworld.zip")
+		c.Assert(errors.Is(err, ErrClockDrift), qt.IsTrue)
+		c.Assert(srv.submissions, qt.HasLen, 0)
+
+		// The failure is not remembered.
+		drift = 0
+		c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+		c.Assert(srv.submissions, qt.HasLen, 1)
+	})
+
+	c.Run("Within threshold", func(c *qt.C) {
+		srv := newServer(30 * time.Second)
+		opts, buf := newTestOptionsWithLog()
+		opts.CheckClockDrift = true
+		opts.StrictClockDrift = true
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+		c.Assert(buf.String(), qt.Not(qt.Contains), "clock")
+	})
+
+	c.Run("Disabled", func(c *qt.C) {
+		srv := newServer(10 * time.Minute)
+		opts, buf := newTestOptionsWithLog()
+		n := srv.newNotarizer(c, opts)
+
+		c.Assert(n.CheckCredentials(context.Background()), qt.IsNil)
+		c.Assert(buf.String(), qt.Not(qt.Contains), "clock")
+	})
+}
+
+func TestErrorFormat(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"StatusError", &StatusError{ID: "abc", Status: "Invalid", LogURL: "https://example.org/logs/abc"}, "unexpected status: Invalid for submission abc (log: https://example.org/logs/abc)"},
+		{"StatusError no log", &StatusError{ID: "abc", Status: "Rejected", LogErr: errors.New("boom")}, "unexpected status: Rejected for submission abc (failed to fetch logs: boom)"},
+		{"APIError", &APIError{StatusCode: 403, Errors: []APIErrorItem{{Code: "FORBIDDEN_ERROR", Title: "Forbidden.", Detail: "No access."}, {Code: "OTHER", Title: "Other."}}}, "notary API responded with status 403: FORBIDDEN_ERROR: Forbidden.: No access.; OTHER: Other."},
+		{"APIError no items", &APIError{StatusCode: 500}, "notary API responded with status 500"},
+		{"DownloadError", &DownloadError{URL: "https://example.org/a.zip", Err: errors.New("404 Not Found")}, "failed to download https://example.org/a.zip: 404 Not Found"},
+	} {
+		c.Run(test.name, func(c *qt.C) {
+			c.Assert(test.err.Error(), qt.Equals, test.want)
+		})
+	}
+}
+
+func TestPrepareAndSubmitPrepared(t *testing.T) {
+	c := qt.New(t)
+
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	filename := filepath.Join(c.TempDir(), "helloworld.zip")
+	c.Assert(os.WriteFile(filename, b, 0o644), qt.IsNil)
+
+	prepared, err := Prepare(filename)
+	c.Assert(err, qt.IsNil)
+	stateFile := filepath.Join(c.TempDir(), "prepared.json")
+	b, err = json.Marshal(prepared)
+	c.Assert(err, qt.IsNil)
+	c.Assert(os.WriteFile(stateFile, b, 0o644), qt.IsNil)
+
+	// On the machine with the credentials.
+	b, err = os.ReadFile(stateFile)
+	c.Assert(err, qt.IsNil)
+	var loaded PreparedSubmission
+	c.Assert(json.Unmarshal(b, &loaded), qt.IsNil)
+	c.Assert(loaded, qt.DeepEquals, PreparedSubmission{
+		Path:           filename,
+		SubmissionName: "helloworld.zip",
+		Sha256:         "a53c8738fdd28a3558057c8825f633860846773baae89cf3e0e36f12896393af",
+	})
+
+	srv := newFakeServer(c)
+	n := srv.newNotarizer(c, newTestOptions())
+	c.Assert(n.SubmitPrepared(context.Background(), &loaded), qt.IsNil)
+	c.Assert(srv.submissions, qt.DeepEquals, []submissionRequest{{Sha256: loaded.Sha256, SubmissionName: "helloworld.zip"}})
+
+	opts := newTestOptions()
+	opts.MaxArtifactSize = 1024
+	small := srv.newNotarizer(c, opts)
+	c.Assert(errors.Is(small.SubmitPrepared(context.Background(), &loaded), ErrArtifactTooLarge), qt.IsTrue)
+	c.Assert(srv.submissions, qt.HasLen, 1)
+
+	c.Assert(os.WriteFile(filename, []byte("changed"), 0o644), qt.IsNil)
+	c.Assert(n.SubmitPrepared(context.Background(), &loaded), qt.ErrorMatches, ".*helloworld.zip has changed since it was prepared: .*")
+	c.Assert(srv.submissions, qt.HasLen, 1)
+}
+
+func TestStripVersionSuffix(t *testing.T) {
+	c := qt.New(t)
+
+	for _, test := range []struct {
+		filename string
+		expect   string
+	}{
+		{"App-1.2.3.zip", "App.zip"},
+		{"dist/App-1.2.3.zip", "App.zip"},
+		{"App_v1.2.dmg", "App.dmg"},
+		{"My App 2.0.1.pkg", "My App.pkg"},
+		{"App-1.2.3-beta.1.zip", "App.zip"},
+		{"App-1.2.3+build.42.zip", "App.zip"},
+		{"hugo_0.101.0_darwin-universal.pkg", "hugo_0.101.0_darwin-universal.pkg"},
+		{"App.zip", "App.zip"},
+		{"App-2.zip", "App-2.zip"},
+		{"1.2.3.zip", "1.2.3.zip"},
+	} {
+		c.Assert(StripVersionSuffix(test.filename), qt.Equals, test.expect, qt.Commentf(test.filename))
+	}
+
+	srv := newFakeServer(c)
+	opts := newTestOptions()
+	opts.SubmissionNameFunc = StripVersionSuffix
+	n := srv.newNotarizer(c, opts)
+	b, err := os.ReadFile("testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	filename := filepath.Join(c.TempDir(), "helloworld-1.0.0.zip")
+	c.Assert(os.WriteFile(filename, b, 0o644), qt.IsNil)
+	c.Assert(n.Submit(filename), qt.IsNil)
+	c.Assert(srv.submissions[0].SubmissionName, qt.Equals, "helloworld.zip")
+}
+
+func TestSubmissionNameFunc(t *testing.T) {
+	c := qt.New(t)
+
+	srv := newFakeServer(c)
+	opts, logs := newTestOptionsWithLog()
+	opts.SubmissionNameFunc = func(filename string) string {
+		return strings.TrimSuffix(filepath.Base(filename), ".zip") + "-build42.zip"
+	}
+	n := srv.newNotarizer(c, opts)
+
+	c.Assert(n.Submit("testdata/helloworld.zip"), qt.IsNil)
+	c.Assert(srv.submissions[0].SubmissionName, qt.Equals, "helloworld-build42.zip")
+	c.Assert(logs.String(), qt.Contains, "[helloworld-build42.zip] Submitting")
+}
+
+func TestVerifyStaple(t *testing.T) {
+	c := qt.New(t)
+
+	if runtime.GOOS != "darwin" {
+		c.Assert(VerifyStaple("testdata/helloworld"), qt.ErrorMatches, "VerifyStaple requires macOS")
+		return
+	}
+
+	// Tickets can't be stapled to zip archives or bare binaries.
+	c.Assert(VerifyStaple("testdata/helloworld.zip"), qt.ErrorMatches, "stapler validation of testdata/helloworld.zip failed.*")
+}
+
+func newTestOptions() Options {
+	return Options{
+		IssuerID: "57246542-96fe-1a63-e053-0824d011072a",
+		Kid:      "ABC123",
+		SignFunc: func(token *jwt.Token) (string, error) {
+			return "signed-token", nil
+		},
+	}
+}
+
+// newTestOptionsWithLog returns test options with the info log captured in the returned buffer.
+func newTestOptionsWithLog() (Options, *syncBuffer) {
+	var logs syncBuffer
+	opts := newTestOptions()
+	opts.InfoLoggerf = func(format string, a ...any) {
+		fmt.Fprintf(&logs, format+"\n", a...)
+	}
+	return opts, &logs
+}
+
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// fakeServer emulates the Notary API and the S3 bucket it hands out credentials for.
+type fakeServer struct {
+	*httptest.Server
+
+	// The statuses returned for consecutive status checks, the last one is repeated.
+	// Defaults to Accepted.
+	statuses []string
+
+	// Optional handler overrides.
+	list   http.HandlerFunc
+	submit http.HandlerFunc
+	upload http.HandlerFunc
+	logs   http.HandlerFunc
+
+	mu          sync.Mutex
+	submissions []submissionRequest
+	uploaded    map[string][]byte
+	polls       int
+}
+
+func newFakeServer(c *qt.C) *fakeServer {
+	s := &fakeServer{uploaded: make(map[string][]byte)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	c.Cleanup(s.Close)
+	return s
+}
+
+// newNotarizer creates a Notarizer talking to s.
+func (s *fakeServer) newNotarizer(c *qt.C, opts Options) *Notarizer {
+	n, err := New(opts)
+	c.Assert(err, qt.IsNil)
+	s.configure(n)
+	return n
+}
+
+func (s *fakeServer) configure(n *Notarizer) {
+	n.baseURL = s.URL + "/notary/v2/submissions"
+	n.s3Endpoint = s.URL
+	n.opts.PollStrategy = PollStrategyFunc(func(int) time.Duration { return 0 })
+}
+
+func (s *fakeServer) uploads() map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploaded
+}
+
+func (s *fakeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	const api = "/notary/v2/submissions"
+	switch {
+	case r.Method == "PUT":
+		if s.upload != nil {
+			s.upload(w, r)
+			return
+		}
+		s.handleUpload(w, r)
+	case r.URL.Path == api && r.Method == "GET":
+		if s.list != nil {
+			s.list(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"data": [], "meta": {}}`)
+	case r.URL.Path == api && r.Method == "POST":
+		if s.submit != nil {
+			s.submit(w, r)
+			return
+		}
+		s.handleSubmit(w, r)
+	case strings.HasSuffix(r.URL.Path, "/logs"):
+		if s.logs != nil {
+			s.logs(w, r)
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, api+"/"), "/logs")
+		fmt.Fprintf(w, `{"data": {"id": %q, "type": "submissionsLog", "attributes": {"developerLogUrl": "https://example.org/logs/%s"}}}`, id, id)
+	case strings.HasPrefix(r.URL.Path, api+"/"):
+		id := strings.TrimPrefix(r.URL.Path, api+"/")
+		if !strings.HasPrefix(id, "submission-") {
+			http.Error(w, `{"errors": [{"status": "404", "code": "NOT_FOUND", "title": "The specified resource does not exist"}]}`, http.StatusNotFound)
+			return
+		}
+		s.mu.Lock()
+		status := "Accepted"
+		if len(s.statuses) > 0 {
+			status = s.statuses[0]
+			if len(s.statuses) > 1 {
+				s.statuses = s.statuses[1:]
+			}
+		}
+		s.polls++
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"data": {"id": %q, "type": "submissions", "attributes": {"status": %q, "name": "helloworld.zip", "createdDate": "2022-08-30T11:13:48.000Z"}}}`, id, status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req submissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.submissions = append(s.submissions, req)
+	id := fmt.Sprintf("submission-%d", len(s.submissions))
+	s.mu.Unlock()
+	fmt.Fprintf(w, `{"data": {"type": "newSubmissions", "id": %q, "attributes": {"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "awsSessionToken": "session", "bucket": "notary-submissions", "object": "prod/%s"}}}`, id, id)
+}
+
+func (s *fakeServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	s.uploaded[r.URL.Path] = b
+	s.mu.Unlock()
+	w.Header().Set("ETag", `"etag"`)
+}
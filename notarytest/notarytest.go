@@ -0,0 +1,25 @@
+// Package notarytest provides helpers for testing code using macosnotarylib.
+// It is meant for tests only.
+package notarytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// NewTestSigner generates an ephemeral P-256 key and returns it with a SignFunc
+// signing tokens with it, ready to use in macosnotarylib.Options.
+// The key is never persisted and is only suitable for tests.
+func NewTestSigner() (*ecdsa.PrivateKey, func(token *jwt.Token) (string, error)) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		// This only fails if the system's random source fails.
+		panic(err)
+	}
+	return key, func(token *jwt.Token) (string, error) {
+		return token.SignedString(key)
+	}
+}
@@ -0,0 +1,120 @@
+package notarytest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bep/macosnotarylib"
+	qt "github.com/frankban/quicktest"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestNewTestSigner(t *testing.T) {
+	c := qt.New(t)
+
+	key, signFunc := NewTestSigner()
+	signed, err := signFunc(jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": "issuer"}))
+	c.Assert(err, qt.IsNil)
+
+	token, err := jwt.Parse(signed, func(token *jwt.Token) (interface{}, error) {
+		return &key.PublicKey, nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(token.Valid, qt.IsTrue)
+	c.Assert(token.Claims.(jwt.MapClaims)["iss"], qt.Equals, "issuer")
+
+	otherKey, _ := NewTestSigner()
+	c.Assert(otherKey.Equal(key), qt.IsFalse)
+}
+
+// TestSubmit submits an artifact against a fake Notary API that verifies the
+// tokens signed by NewTestSigner.
+func TestSubmit(t *testing.T) {
+	c := qt.New(t)
+
+	key, signFunc := NewTestSigner()
+
+	var (
+		mu       sync.Mutex
+		uploaded []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			// The S3 upload.
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			uploaded = b
+			mu.Unlock()
+			w.Header().Set("ETag", `"etag"`)
+			return
+		}
+
+		_, err := jwt.Parse(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), func(token *jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/notary/v2/submissions":
+			fmt.Fprintf(w, `{"data": {"type": "newSubmissions", "id": "submission-1", "attributes": {"awsAccessKeyId": "AKIAEXAMPLE", "awsSecretAccessKey": "secret", "bucket": "notary-submissions", "object": "prod/submission-1", "endpoint": %q}}}`, "http://"+r.Host)
+		case r.Method == "GET" && r.URL.Path == "/notary/v2/submissions/submission-1":
+			fmt.Fprint(w, `{"data": {"id": "submission-1", "type": "submissions", "attributes": {"status": "Accepted", "name": "helloworld.zip", "createdDate": "2022-08-30T11:13:48.000Z"}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	c.Cleanup(srv.Close)
+
+	// Send the Notary API requests and the S3 uploads to srv.
+	apiTransport := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.URL.Scheme = "http"
+		r.URL.Host = srv.Listener.Addr().String()
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	s3Transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, srv.Listener.Addr().String())
+		},
+	}
+
+	n, err := macosnotarylib.New(macosnotarylib.Options{
+		IssuerID:     "57246542-96fe-1a63-e053-0824d011072a",
+		Kid:          "ABC123",
+		SignFunc:     signFunc,
+		HTTPClient:   &http.Client{Transport: apiTransport},
+		S3HTTPClient: &http.Client{Transport: s3Transport},
+		PollStrategy: macosnotarylib.PollStrategyFunc(func(int) time.Duration { return 10 * time.Millisecond }),
+	})
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(n.Submit("../testdata/helloworld.zip"), qt.IsNil)
+	want, err := os.ReadFile("../testdata/helloworld.zip")
+	c.Assert(err, qt.IsNil)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(uploaded, qt.DeepEquals, want)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}